@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package types
+
+import "fmt"
+
+// Indexer extends Store with named indices, each one mapping the values given by
+// an IndexFunc to the keys of the objects having them.
+type Indexer interface {
+	Store
+	// Index returns the stored objects sharing an indexed value with obj.
+	Index(indexName string, obj interface{}) ([]interface{}, error)
+	// IndexKeys returns the keys of the stored objects having the indexed value.
+	IndexKeys(indexName, indexedValue string) ([]string, error)
+	// ListIndexFuncValues returns the values of the named index.
+	ListIndexFuncValues(indexName string) []string
+	// ByIndex returns the stored objects having the indexed value.
+	ByIndex(indexName, indexedValue string) ([]interface{}, error)
+	// GetIndexers returns the registered indexers.
+	GetIndexers() Indexers
+	// AddIndexers registers new indexers and indexes the stored objects with
+	// them.
+	AddIndexers(newIndexers Indexers) error
+}
+
+// IndexFunc knows how to compute the indexed values of an object. Implementations
+// should be deterministic.
+type IndexFunc func(obj interface{}) ([]string, error)
+
+// Indexers maps an index name to its IndexFunc.
+type Indexers map[string]IndexFunc
+
+// IndexError will be returned any time an IndexFunc gives an error; it includes the
+// index and the object at fault.
+type IndexError struct {
+	IndexName string
+	Obj       interface{}
+	Err       error
+}
+
+// Error gives a human-readable description of the error.
+func (i IndexError) Error() string {
+	return fmt.Sprintf("couldn't compute index %q for object %+v: %v", i.IndexName, i.Obj, i.Err)
+}
@@ -22,40 +22,172 @@
 package relation
 
 import (
+	"context"
+	"io"
+	"time"
+
 	"github.com/firemiles/go-cache/pkg/types"
 )
 
 // ReferFunc knows how to get refers from an object. Implementations should be deterministic.
+// The refers are of the DefaultReferKind, see TypedReferFunc for kinded refers.
 type ReferFunc func(obj interface{}) ([]string, error)
 
 // Cache is a week reference relationship trace memory cache. ,
-// you can delete one object which referenced by other without any error.
+// you can delete one object which referenced by other without any error,
+// unless the reference is made strong with WithStrongReferences or
+// WithStrongReferencesFunc, then Delete returns a ReferencedError.
 type Cache interface {
-	types.Store
+	types.Indexer
 	Referenced(object interface{}) ([]interface{}, error)
 	ReferencedKeys(key string) ([]string, error)
 	ReferKeys(key string) ([]string, error)
+	// Refers lists the refers of key with their kinds, sorted by key and kind.
+	Refers(key string) ([]Refer, error)
+	// ReferKeysOfKind lists the keys key refers to with kind.
+	ReferKeysOfKind(key string, kind string) ([]string, error)
+	// ReferencedKeysOfKind lists the keys referring to key with kind.
+	ReferencedKeysOfKind(key string, kind string) ([]string, error)
+	// ReferencedOfKind lists the objects referring to obj with kind.
+	ReferencedOfKind(obj interface{}, kind string) ([]interface{}, error)
+	// ReplaceWithDelta works like Replace and reports which keys were added,
+	// removed and changed relative to the previous contents.
+	ReplaceWithDelta(list []interface{}) (ReplaceDelta, error)
+	// UnresolvedKeys lists in order the keys of objects stored without refers
+	// because the ReferFunc failed on them, see WithUnresolvedRefers.
+	UnresolvedKeys() []string
+	// DanglingKeys lists the keys referred to by stored objects but not stored
+	// themselves.
+	DanglingKeys() []string
+	// DanglingRefers lists the refers of key which are not stored.
+	DanglingRefers(key string) ([]string, error)
+	// TransitiveReferKeys lists the keys key refers to directly or indirectly
+	// in breadth first order, with the depth and the path each was reached by.
+	// At most maxDepth references are followed if maxDepth is positive.
+	TransitiveReferKeys(key string, maxDepth int) ([]ReachedKey, error)
+	// TransitiveReferencedKeys is TransitiveReferKeys in the other direction,
+	// it lists the keys referring to key directly or indirectly.
+	TransitiveReferencedKeys(key string, maxDepth int) ([]ReachedKey, error)
+	// FindCycles returns the strongly connected components of the reference
+	// graph which contain a cycle, each one as a sorted list of keys.
+	FindCycles() [][]string
+	// TopologicalKeys orders the stored keys so that each key comes after the
+	// keys it refers to, the order to create objects in. References to keys
+	// which aren't stored are ignored. A CycleError is returned if no such
+	// order exists.
+	TopologicalKeys() ([]string, error)
+	// ReverseTopologicalKeys is the reverse of TopologicalKeys, the order to
+	// delete objects in.
+	ReverseTopologicalKeys() ([]string, error)
+	// TopologicalKeysFrom is TopologicalKeys limited to the roots and the keys
+	// they refer to directly or indirectly.
+	TopologicalKeysFrom(roots ...string) ([]string, error)
+	// ReverseTopologicalKeysFrom is the reverse of TopologicalKeysFrom.
+	ReverseTopologicalKeysFrom(roots ...string) ([]string, error)
+	// DeleteCascade deletes obj and, depending on propagation, the objects
+	// referring to it in one atomic step. It returns the deleted keys in the
+	// order they were deleted.
+	DeleteCascade(obj interface{}, propagation DeletionPropagation) ([]string, error)
+	// Watch returns a channel receiving an Event for every mutation matching
+	// filter, all of them if filter is nil, until ctx is done and the channel
+	// is closed. The events are sent in the order of the mutations.
+	Watch(ctx context.Context, filter func(Event) bool, opts ...WatchOption) (<-chan Event, error)
+	// ListWithVersion lists the objects along with the version of the cache,
+	// to watch for the changes made after listing with WatchFromVersion.
+	ListWithVersion() ([]interface{}, uint64)
+	// GetWithVersion is Get also returning the version of the object, the
+	// version of the cache when the object was last added or updated.
+	GetWithVersion(obj interface{}) (item interface{}, version uint64, exists bool, err error)
+	// GetByKeyWithVersion is GetByKey also returning the version of the object.
+	GetByKeyWithVersion(key string) (item interface{}, version uint64, exists bool, err error)
+	// UpdateIfVersion updates obj only if the stored object is still at
+	// expectedVersion, else it returns a ConflictError. An expectedVersion
+	// of 0 adds obj only if no object is stored under its key.
+	UpdateIfVersion(obj interface{}, expectedVersion uint64) error
+	// Begin starts a transaction, its mutations are applied at once by
+	// Txn.Commit.
+	Begin() Txn
+	// AddWithTTL stores obj until ttl elapses, then it expires: it is deleted
+	// when it is got, or by DeleteExpired, unless it is still strongly
+	// referenced. Until then the listings and the index queries leave it out,
+	// the reference queries don't. DefaultExpiration stands for the TTL set by
+	// WithDefaultTTL, NoExpiration for none.
+	AddWithTTL(obj interface{}, ttl time.Duration) error
+	// DeleteExpired deletes the expired objects and returns their keys, an
+	// Expired event is sent for each of them.
+	DeleteExpired() []string
+	// Stop stops the janitor started by WithJanitor, if any.
+	Stop()
+	// SetCollectable marks obj as collectable, or unmarks it: once nothing
+	// refers to it anymore it is deleted, at once or by RunGC after the grace
+	// period set by WithGCGracePeriod, and a Collected event is sent. Marking
+	// obj when nothing refers to it doesn't delete it, RunGC does. Deleting
+	// obj unmarks it. Marks aren't saved by SaveSnapshot nor logged, see
+	// WithCollectable to mark objects by their contents.
+	SetCollectable(obj interface{}, collectable bool) error
+	// RunGC deletes the collectable objects nothing refers to, and the objects
+	// without owner left, for the grace period and returns their keys. Unless
+	// there is a grace period, the objects they were the last to refer to or
+	// to own follow. See WithOwnerGC.
+	RunGC() []string
+	// SaveSnapshot writes the objects of the cache to w, for LoadSnapshot to
+	// restore them, see WithCodec.
+	SaveSnapshot(w io.Writer) error
+	// LoadSnapshot replaces the contents of the cache with the objects saved
+	// to r by SaveSnapshot, the relations are rebuilt from them. The cache is
+	// left unchanged if r doesn't hold a valid snapshot.
+	LoadSnapshot(r io.Reader) error
+	// Snapshot returns a read-only view of the cache frozen at the time of the
+	// call, later mutations of the cache don't show through it. Its writes
+	// return ErrReadOnly.
+	Snapshot() Snapshot
+}
+
+// Snapshot is a read-only Cache frozen at the time it was taken.
+type Snapshot interface {
+	Cache
+	// Release tells the snapshot is no longer used, it must not be used after.
+	// Releasing snapshots spares the cache copying its contents on the next
+	// write.
+	Release()
 }
 
 type cache struct {
 	cacheStorage RelationStore
 	keyFunc      types.KeyFunc
+	codec        Codec
+	janitor      *janitor
 }
 
 var _ Cache = &cache{}
 
 // NewCache ...
-func NewCache(keyFunc types.KeyFunc, referFunc ReferFunc) Cache {
+func NewCache(keyFunc types.KeyFunc, referFunc ReferFunc, opts ...Option) Cache {
 	c := new(cache)
-	c.cacheStorage = NewThreadSafeMap(referFunc)
+	options := newOptions(opts)
+	switch {
+	case options.copyOnWrite:
+		c.cacheStorage = NewCopyOnWriteMap(referFunc, opts...)
+	case options.shards > 1:
+		c.cacheStorage = NewShardedMap(referFunc, opts...)
+	default:
+		c.cacheStorage = NewThreadSafeMap(referFunc, opts...)
+	}
 	c.keyFunc = keyFunc
+	c.codec = options.codec
+	if c.codec == nil {
+		c.codec = NewGobCodec()
+	}
+	if options.janitorInterval > 0 {
+		c.janitor = startJanitor(c.cacheStorage, options.janitorInterval)
+	}
 	return c
 }
 
 func (c *cache) Add(obj interface{}) error {
 	key, err := c.keyFunc(obj)
 	if err != nil {
-		return types.KeyError{obj, err}
+		return types.KeyError{Obj: obj, Err: err}
 	}
 	return c.cacheStorage.Add(key, obj)
 }
@@ -63,23 +195,110 @@ func (c *cache) Add(obj interface{}) error {
 func (c *cache) Update(obj interface{}) error {
 	key, err := c.keyFunc(obj)
 	if err != nil {
-		return types.KeyError{obj, err}
+		return types.KeyError{Obj: obj, Err: err}
 	}
 	return c.cacheStorage.Update(key, obj)
 }
 
+func (c *cache) UpdateIfVersion(obj interface{}, expectedVersion uint64) error {
+	key, err := c.keyFunc(obj)
+	if err != nil {
+		return types.KeyError{Obj: obj, Err: err}
+	}
+	return c.cacheStorage.UpdateIfVersion(key, obj, expectedVersion)
+}
+
+func (c *cache) Begin() Txn {
+	return &txn{cache: c}
+}
+
+func (c *cache) Snapshot() Snapshot {
+	store := c.cacheStorage.Snapshot()
+	return &cacheSnapshot{cache: &cache{cacheStorage: store, keyFunc: c.keyFunc, codec: c.codec}, store: store}
+}
+
+type cacheSnapshot struct {
+	*cache
+	store StoreSnapshot
+}
+
+func (s *cacheSnapshot) Release() {
+	s.store.Release()
+}
+
 func (c *cache) Delete(obj interface{}) error {
 	key, err := c.keyFunc(obj)
 	if err != nil {
-		return types.KeyError{obj, err}
+		return types.KeyError{Obj: obj, Err: err}
 	}
 	return c.cacheStorage.Delete(key)
 }
 
+func (c *cache) DanglingKeys() []string {
+	return c.cacheStorage.DanglingKeys()
+}
+
+func (c *cache) DanglingRefers(key string) ([]string, error) {
+	return c.cacheStorage.DanglingRefers(key)
+}
+
+func (c *cache) TransitiveReferKeys(key string, maxDepth int) ([]ReachedKey, error) {
+	return c.cacheStorage.TransitiveReferKeys(key, maxDepth)
+}
+
+func (c *cache) TransitiveReferencedKeys(key string, maxDepth int) ([]ReachedKey, error) {
+	return c.cacheStorage.TransitiveReferencedKeys(key, maxDepth)
+}
+
+func (c *cache) FindCycles() [][]string {
+	return c.cacheStorage.FindCycles()
+}
+
+func (c *cache) TopologicalKeys() ([]string, error) {
+	return c.cacheStorage.TopologicalKeys()
+}
+
+func (c *cache) ReverseTopologicalKeys() ([]string, error) {
+	keys, err := c.cacheStorage.TopologicalKeys()
+	return reverseKeys(keys), err
+}
+
+func (c *cache) TopologicalKeysFrom(roots ...string) ([]string, error) {
+	return c.cacheStorage.TopologicalKeysFrom(roots)
+}
+
+func (c *cache) ReverseTopologicalKeysFrom(roots ...string) ([]string, error) {
+	keys, err := c.cacheStorage.TopologicalKeysFrom(roots)
+	return reverseKeys(keys), err
+}
+
+func reverseKeys(keys []string) []string {
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+	return keys
+}
+
+func (c *cache) Watch(ctx context.Context, filter func(Event) bool, opts ...WatchOption) (<-chan Event, error) {
+	return c.cacheStorage.Watch(ctx, filter, opts...)
+}
+
+func (c *cache) DeleteCascade(obj interface{}, propagation DeletionPropagation) ([]string, error) {
+	key, err := c.keyFunc(obj)
+	if err != nil {
+		return nil, types.KeyError{Obj: obj, Err: err}
+	}
+	return c.cacheStorage.DeleteCascade(key, propagation)
+}
+
 func (c *cache) List() []interface{} {
 	return c.cacheStorage.List()
 }
 
+func (c *cache) ListWithVersion() ([]interface{}, uint64) {
+	return c.cacheStorage.ListWithVersion()
+}
+
 func (c *cache) ListKeys() []string {
 	return c.cacheStorage.ListKeys()
 }
@@ -87,7 +306,7 @@ func (c *cache) ListKeys() []string {
 func (c *cache) Get(obj interface{}) (item interface{}, exists bool, err error) {
 	key, err := c.keyFunc(obj)
 	if err != nil {
-		return nil, false, types.KeyError{obj, err}
+		return nil, false, types.KeyError{Obj: obj, Err: err}
 	}
 	return c.GetByKey(key)
 }
@@ -97,22 +316,64 @@ func (c *cache) GetByKey(key string) (item interface{}, exists bool, err error)
 	return item, exists, nil
 }
 
+func (c *cache) GetWithVersion(obj interface{}) (item interface{}, version uint64, exists bool, err error) {
+	key, err := c.keyFunc(obj)
+	if err != nil {
+		return nil, 0, false, types.KeyError{Obj: obj, Err: err}
+	}
+	return c.GetByKeyWithVersion(key)
+}
+
+func (c *cache) GetByKeyWithVersion(key string) (item interface{}, version uint64, exists bool, err error) {
+	item, version, exists = c.cacheStorage.GetWithVersion(key)
+	return item, version, exists, nil
+}
+
 func (c *cache) Replace(list []interface{}) error {
+	_, err := c.ReplaceWithDelta(list)
+	return err
+}
+
+func (c *cache) ReplaceWithDelta(list []interface{}) (ReplaceDelta, error) {
 	items := make(map[string]interface{}, len(list))
 	for _, item := range list {
 		key, err := c.keyFunc(item)
 		if err != nil {
-			return types.KeyError{item, err}
+			return ReplaceDelta{}, types.KeyError{Obj: item, Err: err}
 		}
 		items[key] = item
 	}
 	return c.cacheStorage.Replace(items)
 }
 
+func (c *cache) Index(indexName string, obj interface{}) ([]interface{}, error) {
+	return c.cacheStorage.Index(indexName, obj)
+}
+
+func (c *cache) IndexKeys(indexName, indexedValue string) ([]string, error) {
+	return c.cacheStorage.IndexKeys(indexName, indexedValue)
+}
+
+func (c *cache) ListIndexFuncValues(indexName string) []string {
+	return c.cacheStorage.ListIndexFuncValues(indexName)
+}
+
+func (c *cache) ByIndex(indexName, indexedValue string) ([]interface{}, error) {
+	return c.cacheStorage.ByIndex(indexName, indexedValue)
+}
+
+func (c *cache) GetIndexers() types.Indexers {
+	return c.cacheStorage.GetIndexers()
+}
+
+func (c *cache) AddIndexers(newIndexers types.Indexers) error {
+	return c.cacheStorage.AddIndexers(newIndexers)
+}
+
 func (c *cache) Referenced(obj interface{}) ([]interface{}, error) {
 	key, err := c.keyFunc(obj)
 	if err != nil {
-		return nil, types.KeyError{obj, err}
+		return nil, types.KeyError{Obj: obj, Err: err}
 	}
 	return c.cacheStorage.Referenced(key)
 }
@@ -125,4 +386,26 @@ func (c *cache) ReferKeys(key string) ([]string, error) {
 	return c.cacheStorage.ReferKeys(key)
 }
 
+func (c *cache) Refers(key string) ([]Refer, error) {
+	return c.cacheStorage.Refers(key)
+}
+
+func (c *cache) ReferKeysOfKind(key string, kind string) ([]string, error) {
+	return c.cacheStorage.ReferKeysOfKind(key, kind)
+}
+
+func (c *cache) ReferencedKeysOfKind(key string, kind string) ([]string, error) {
+	return c.cacheStorage.ReferencedKeysOfKind(key, kind)
+}
+
+func (c *cache) ReferencedOfKind(obj interface{}, kind string) ([]interface{}, error) {
+	key, err := c.keyFunc(obj)
+	if err != nil {
+		return nil, types.KeyError{Obj: obj, Err: err}
+	}
+	return c.cacheStorage.ReferencedOfKind(key, kind)
+}
 
+func (c *cache) UnresolvedKeys() []string {
+	return c.cacheStorage.UnresolvedKeys()
+}
@@ -24,9 +24,12 @@ package relation
 import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"errors"
 	"math/rand"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type Object struct {
@@ -48,9 +51,60 @@ func ObjectRefers(obj interface{}) ([]string, error) {
 	return list, nil
 }
 
+var errBadObject = errors.New("bad object")
+
+// BadObjectRefers fails on objects which refer to an object without ID.
+func BadObjectRefers(obj interface{}) ([]string, error) {
+	o := obj.(*Object)
+	for _, sub := range o.SubObjects {
+		if sub.ID == "" {
+			return nil, errBadObject
+		}
+	}
+	return ObjectRefers(obj)
+}
+
+// newObject returns an object referring to new objects of the IDs in refers.
+func newObject(id string, refers ...string) *Object {
+	obj := &Object{ID: id}
+	for _, refer := range refers {
+		obj.SubObjects = append(obj.SubObjects, &Object{ID: refer})
+	}
+	return obj
+}
+
+// fakeNow is the time told by fakeClock, the specs set it.
+var fakeNow time.Time
+
+// fakeClock is an Option making a cache tell the time by fakeNow.
+func fakeClock(o *options) {
+	o.now = func() time.Time {
+		return fakeNow
+	}
+}
+
+// engines are the stores of a cache and the options selecting them.
+var engines = []struct {
+	name string
+	opts []Option
+}{
+	{"thread safe map", nil},
+	{"sharded map", []Option{WithShards(4)}},
+	{"copy-on-write", []Option{WithCopyOnWrite()}},
+}
+
+// forEachEngine declares the specs of declare for every store, opts are its own
+// copy of the options selecting the store.
+func forEachEngine(declare func(name string, opts []Option)) {
+	for _, engine := range engines {
+		declare(engine.name, append([]Option(nil), engine.opts...))
+	}
+}
+
 var objectCache = &cache {
-	NewThreadSafeMap(ObjectRefers),
-	ObjectKey,
+	cacheStorage: NewThreadSafeMap(ObjectRefers),
+	keyFunc:      ObjectKey,
+	codec:        NewGobCodec(),
 }
 
 func TestRelationCache(t *testing.T) {
@@ -110,8 +164,10 @@ var _ = Describe("Unit test", func() {
 
 	It("Delete sub object", func() {
 		Expect(c.Delete(subObj1)).ShouldNot(HaveOccurred())
-		_, err := c.ReferencedKeys(subObj1.ID)
-		Expect(err).Should(HaveOccurred())
+		referenced, err := c.ReferencedKeys(subObj1.ID)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(referenced).Should(Equal([]string{obj1.ID}))
+		Expect(c.DanglingKeys()).Should(Equal([]string{subObj1.ID}))
 	})
 
 	It("Delete root object", func() {
@@ -183,5 +239,226 @@ var _ = Describe("Unit test", func() {
 	})
 })
 
+var _ = Describe("Refers error", func() {
+	subObj1 := &Object{ID: "sub_object1"}
+	obj1 := &Object{ID: "object1", SubObjects: []*Object{subObj1}}
+	badObj1 := &Object{ID: "object1", SubObjects: []*Object{{}}}
+
+	It("Reject object with bad refers", func() {
+		c := NewCache(ObjectKey, BadObjectRefers)
+		Expect(c.Add(obj1)).ShouldNot(HaveOccurred())
+
+		err := c.Update(badObj1)
+		Expect(err).Should(HaveOccurred())
+		refersErr, ok := err.(RefersError)
+		Expect(ok).Should(BeTrue())
+		Expect(refersErr.Key).Should(Equal(obj1.ID))
+		Expect(refersErr.Err).Should(Equal(errBadObject))
+
+		item, exists, err := c.Get(obj1)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(exists).Should(BeTrue())
+		Expect(item).Should(Equal(obj1))
+		referenced, err := c.ReferencedKeys(subObj1.ID)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(referenced).Should(Equal([]string{obj1.ID}))
+		Expect(c.UnresolvedKeys()).Should(BeEmpty())
+	})
+
+	It("Store object with unresolved refers", func() {
+		c := NewCache(ObjectKey, BadObjectRefers, WithUnresolvedRefers())
+		Expect(c.Add(obj1)).ShouldNot(HaveOccurred())
+		Expect(c.Update(badObj1)).ShouldNot(HaveOccurred())
+
+		item, exists, _ := c.Get(obj1)
+		Expect(exists).Should(BeTrue())
+		Expect(item).Should(Equal(badObj1))
+		Expect(c.UnresolvedKeys()).Should(Equal([]string{obj1.ID}))
+		refers, err := c.ReferKeys(obj1.ID)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(refers).Should(BeEmpty())
+		Expect(c.DanglingKeys()).Should(BeEmpty())
+
+		for _, id := range []string{"object9", "object0", "object5"} {
+			Expect(c.Add(&Object{ID: id, SubObjects: []*Object{{}}})).ShouldNot(HaveOccurred())
+		}
+		Expect(c.UnresolvedKeys()).Should(Equal([]string{"object0", "object1", "object5", "object9"}))
+		for _, id := range []string{"object9", "object0", "object5"} {
+			Expect(c.Delete(&Object{ID: id})).ShouldNot(HaveOccurred())
+		}
+
+		Expect(c.Update(obj1)).ShouldNot(HaveOccurred())
+		Expect(c.UnresolvedKeys()).Should(BeEmpty())
+	})
+
+	It("Delete object modified in place", func() {
+		c := NewCache(ObjectKey, ObjectRefers)
+		obj := &Object{ID: "object2", SubObjects: []*Object{subObj1}}
+		Expect(c.Add(obj)).ShouldNot(HaveOccurred())
+		obj.SubObjects = nil
+		Expect(c.Delete(obj)).ShouldNot(HaveOccurred())
+		Expect(c.DanglingKeys()).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("Replace", func() {
+	subObj1 := &Object{ID: "sub_object1"}
+	subObj2 := &Object{ID: "sub_object2"}
+	obj1 := &Object{ID: "object1", SubObjects: []*Object{subObj1}}
+	obj2 := &Object{ID: "object2", SubObjects: []*Object{subObj1, subObj2}}
+
+	It("Rebuild relations", func() {
+		c := NewCache(ObjectKey, ObjectRefers)
+		Expect(c.Add(obj1)).ShouldNot(HaveOccurred())
+		Expect(c.Add(subObj1)).ShouldNot(HaveOccurred())
+
+		newObj1 := &Object{ID: obj1.ID, SubObjects: []*Object{subObj2}}
+		delta, err := c.ReplaceWithDelta([]interface{}{newObj1, obj2, subObj2})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(delta).Should(Equal(ReplaceDelta{
+			Added:   []string{obj2.ID, subObj2.ID},
+			Removed: []string{subObj1.ID},
+			Changed: []string{obj1.ID},
+		}))
+
+		refers, err := c.ReferKeys(obj1.ID)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(refers).Should(Equal([]string{subObj2.ID}))
+		referenced, err := c.ReferencedKeys(subObj2.ID)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(referenced).Should(ConsistOf(obj1.ID, obj2.ID))
+		referenced, err = c.ReferencedKeys(subObj1.ID)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(referenced).Should(Equal([]string{obj2.ID}))
+	})
+
+	It("Keep contents on refers error", func() {
+		c := NewCache(ObjectKey, BadObjectRefers)
+		Expect(c.Add(obj1)).ShouldNot(HaveOccurred())
+		badObj := &Object{ID: "bad", SubObjects: []*Object{{}}}
+		Expect(c.Replace([]interface{}{obj2, badObj})).Should(BeAssignableToTypeOf(RefersError{}))
+		Expect(c.ListKeys()).Should(Equal([]string{obj1.ID}))
+		referenced, err := c.ReferencedKeys(subObj1.ID)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(referenced).Should(Equal([]string{obj1.ID}))
+	})
+})
+
+var _ = Describe("Strong references", func() {
+	subObj1 := &Object{ID: "sub_object1"}
+	subObj2 := &Object{ID: "sub_object2"}
+	obj1 := &Object{ID: "object1", SubObjects: []*Object{subObj1, subObj2}}
+	obj2 := &Object{ID: "object2", SubObjects: []*Object{subObj1}}
+
+	It("Reject delete of referenced object", func() {
+		c := NewCache(ObjectKey, ObjectRefers, WithStrongReferences())
+		for _, obj := range []*Object{obj1, obj2, subObj1} {
+			Expect(c.Add(obj)).ShouldNot(HaveOccurred())
+		}
+		err := c.Delete(subObj1)
+		Expect(err).Should(Equal(ReferencedError{Key: subObj1.ID, Referrers: []string{obj1.ID, obj2.ID}}))
+		_, exists, _ := c.Get(subObj1)
+		Expect(exists).Should(BeTrue())
+
+		Expect(c.Delete(obj1)).ShouldNot(HaveOccurred())
+		Expect(c.Delete(obj2)).ShouldNot(HaveOccurred())
+		Expect(c.Delete(subObj1)).ShouldNot(HaveOccurred())
+	})
+
+	It("Reject delete of strong edge only", func() {
+		c := NewCache(ObjectKey, ObjectRefers, WithStrongReferencesFunc(func(referrer, referent string) bool {
+			return referrer == obj2.ID
+		}))
+		for _, obj := range []*Object{obj1, obj2, subObj1, subObj2} {
+			Expect(c.Add(obj)).ShouldNot(HaveOccurred())
+		}
+		Expect(c.Delete(subObj2)).ShouldNot(HaveOccurred())
+		Expect(c.Delete(subObj1)).Should(Equal(ReferencedError{Key: subObj1.ID, Referrers: []string{obj2.ID}}))
+	})
+})
+
+var _ = Describe("Dangling references", func() {
+	subObj1 := &Object{ID: "sub_object1"}
+	subObj2 := &Object{ID: "sub_object2"}
+	obj1 := &Object{ID: "object1", SubObjects: []*Object{subObj1, subObj2}}
+	obj2 := &Object{ID: "object2", SubObjects: []*Object{subObj1}}
 
+	It("Track dangling refers", func() {
+		var resolved []string
+		var c Cache
+		c = NewCache(ObjectKey, ObjectRefers, WithDanglingResolvedFunc(func(key string, referrers []string) {
+			_, exists, _ := c.GetByKey(key)
+			Expect(exists).Should(BeTrue())
+			resolved = append(resolved, key+"<-"+strings.Join(referrers, ","))
+		}))
+		Expect(c.Add(obj1)).ShouldNot(HaveOccurred())
+		Expect(c.Add(obj2)).ShouldNot(HaveOccurred())
+		Expect(c.DanglingKeys()).Should(Equal([]string{subObj1.ID, subObj2.ID}))
+		refers, err := c.DanglingRefers(obj1.ID)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(refers).Should(Equal([]string{subObj1.ID, subObj2.ID}))
+
+		Expect(c.Add(subObj1)).ShouldNot(HaveOccurred())
+		Expect(c.Add(subObj1)).ShouldNot(HaveOccurred())
+		Expect(resolved).Should(Equal([]string{"sub_object1<-object1,object2"}))
+		Expect(c.DanglingKeys()).Should(Equal([]string{subObj2.ID}))
+		refers, err = c.DanglingRefers(obj1.ID)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(refers).Should(Equal([]string{subObj2.ID}))
+
+		Expect(c.Delete(obj1)).ShouldNot(HaveOccurred())
+		Expect(c.DanglingKeys()).Should(BeEmpty())
+		Expect(c.Delete(subObj1)).ShouldNot(HaveOccurred())
+		Expect(c.DanglingKeys()).Should(Equal([]string{subObj1.ID}))
+		referenced, err := c.Referenced(subObj1)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(referenced).Should(Equal([]interface{}{obj2}))
+
+		Expect(c.Replace([]interface{}{obj2, subObj1})).ShouldNot(HaveOccurred())
+		Expect(resolved).Should(Equal([]string{"sub_object1<-object1,object2", "sub_object1<-object2"}))
+		Expect(c.DanglingKeys()).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("Resource versions", func() {
+	subObj1 := &Object{ID: "sub_object1"}
+	obj1 := &Object{ID: "object1", SubObjects: []*Object{subObj1}}
 
+	It("Version objects", func() {
+		c := NewCache(ObjectKey, ObjectRefers)
+		Expect(c.Add(obj1)).ShouldNot(HaveOccurred())
+		Expect(c.Add(subObj1)).ShouldNot(HaveOccurred())
+		_, version, exists, err := c.GetWithVersion(obj1)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(exists).Should(BeTrue())
+		Expect(version).Should(Equal(uint64(1)))
+
+		Expect(c.Update(obj1)).ShouldNot(HaveOccurred())
+		_, version, _, _ = c.GetByKeyWithVersion(obj1.ID)
+		Expect(version).Should(Equal(uint64(3)))
+
+		Expect(c.Replace([]interface{}{obj1, &Object{ID: subObj1.ID, SubObjects: []*Object{{ID: "x"}}}})).ShouldNot(HaveOccurred())
+		_, version, _, _ = c.GetByKeyWithVersion(obj1.ID)
+		Expect(version).Should(Equal(uint64(3)))
+		_, version, _, _ = c.GetByKeyWithVersion(subObj1.ID)
+		Expect(version).Should(Equal(uint64(4)))
+
+		Expect(c.Delete(obj1)).ShouldNot(HaveOccurred())
+		_, version, exists, _ = c.GetByKeyWithVersion(obj1.ID)
+		Expect(exists).Should(BeFalse())
+		Expect(version).Should(BeZero())
+	})
+
+	It("Update if version", func() {
+		c := NewCache(ObjectKey, ObjectRefers)
+		Expect(c.UpdateIfVersion(obj1, 0)).ShouldNot(HaveOccurred())
+		Expect(c.UpdateIfVersion(obj1, 0)).Should(Equal(ConflictError{Key: obj1.ID, Expected: 0, Actual: 1}))
+
+		newObj1 := &Object{ID: obj1.ID}
+		Expect(c.UpdateIfVersion(newObj1, 1)).ShouldNot(HaveOccurred())
+		Expect(c.UpdateIfVersion(obj1, 1)).Should(Equal(ConflictError{Key: obj1.ID, Expected: 1, Actual: 2}))
+		item, version, _, _ := c.GetWithVersion(obj1)
+		Expect(item).Should(Equal(newObj1))
+		Expect(version).Should(Equal(uint64(2)))
+	})
+})
@@ -0,0 +1,362 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/firemiles/go-cache/pkg/types"
+)
+
+// cowMap is a threadSafeMap on persistent maps. Releasing the write lock
+// publishes a frozen view of the contents and of the indices, which the reads
+// use without locking.
+type cowMap struct {
+	*threadSafeMap
+	storage *persistentStorage
+	// view holds the *snapshotMap published last.
+	view atomic.Value
+}
+
+var _ RelationStore = &cowMap{}
+
+// NewCopyOnWriteMap returns a RelationStore whose reads never wait for writers,
+// writers copy what they change instead of modifying it in place. It suits
+// workloads of mostly reads, a write costs more than with NewThreadSafeMap.
+func NewCopyOnWriteMap(referFunc ReferFunc, opts ...Option) RelationStore {
+	c := &cowMap{storage: newPersistentStorage()}
+	lock := &cowLock{publish: c.publish}
+	c.threadSafeMap = newThreadSafeMap(referFunc, c.storage, lock, newOptions(opts))
+	c.publish()
+	return c
+}
+
+// cowLock publishes the contents whenever the write lock is released.
+type cowLock struct {
+	sync.RWMutex
+	publish func()
+}
+
+func (l *cowLock) Unlock() {
+	l.publish()
+	l.RWMutex.Unlock()
+}
+
+// publish freezes the contents for the readers, the caller holds the write
+// lock. Unlike a snapshot, the view hides the expired objects.
+func (c *cowMap) publish() {
+	frozen := c.storage.freeze()
+	view := newSnapshotMap(c.threadSafeMap, frozen, c.broadcaster.currentVersion(), nil)
+	view.keepExpired = false
+	view.indices = make(map[string]index, len(c.indices))
+	for name, idx := range c.indices {
+		view.indices[name] = idx.(*persistentIndex).freeze(frozen)
+	}
+	c.view.Store(view)
+}
+
+func (c *cowMap) current() *snapshotMap {
+	return c.view.Load().(*snapshotMap)
+}
+
+// Snapshot shares the contents and the indices of the view published last,
+// they are never modified so taking and releasing it cost next to nothing.
+func (c *cowMap) Snapshot() StoreSnapshot {
+	view := c.current()
+	snapshot := newSnapshotMap(view.threadSafeMap, view.store, view.version, nil)
+	snapshot.indices = view.indices
+	return snapshot
+}
+
+func (c *cowMap) List() []interface{} {
+	return c.current().List()
+}
+
+func (c *cowMap) ListKeys() []string {
+	return c.current().ListKeys()
+}
+
+func (c *cowMap) Get(key string) (item interface{}, exists bool) {
+	item, _, exists = c.GetWithVersion(key)
+	return item, exists
+}
+
+func (c *cowMap) GetWithVersion(key string) (item interface{}, version uint64, exists bool) {
+	item, version, exists, expired := c.current().lookup(key)
+	if expired && c.expireKey(key) {
+		return nil, 0, false
+	}
+	if exists {
+		c.accessed(key)
+	}
+	return item, version, exists
+}
+
+func (c *cowMap) ListWithVersion() ([]interface{}, uint64) {
+	return c.current().ListWithVersion()
+}
+
+func (c *cowMap) Referenced(key string) ([]interface{}, error) {
+	return c.current().Referenced(key)
+}
+
+func (c *cowMap) ReferencedKeys(key string) ([]string, error) {
+	return c.current().ReferencedKeys(key)
+}
+
+func (c *cowMap) ReferKeys(key string) ([]string, error) {
+	return c.current().ReferKeys(key)
+}
+
+func (c *cowMap) UnresolvedKeys() []string {
+	return c.current().UnresolvedKeys()
+}
+
+func (c *cowMap) Refers(key string) ([]Refer, error) {
+	return c.current().Refers(key)
+}
+
+func (c *cowMap) ReferKeysOfKind(key string, kind string) ([]string, error) {
+	return c.current().ReferKeysOfKind(key, kind)
+}
+
+func (c *cowMap) ReferencedKeysOfKind(key string, kind string) ([]string, error) {
+	return c.current().ReferencedKeysOfKind(key, kind)
+}
+
+func (c *cowMap) ReferencedOfKind(key string, kind string) ([]interface{}, error) {
+	return c.current().ReferencedOfKind(key, kind)
+}
+
+func (c *cowMap) DanglingKeys() []string {
+	return c.current().DanglingKeys()
+}
+
+func (c *cowMap) DanglingRefers(key string) ([]string, error) {
+	return c.current().DanglingRefers(key)
+}
+
+func (c *cowMap) TransitiveReferKeys(key string, maxDepth int) ([]ReachedKey, error) {
+	return c.current().TransitiveReferKeys(key, maxDepth)
+}
+
+func (c *cowMap) TransitiveReferencedKeys(key string, maxDepth int) ([]ReachedKey, error) {
+	return c.current().TransitiveReferencedKeys(key, maxDepth)
+}
+
+func (c *cowMap) Index(indexName string, obj interface{}) ([]interface{}, error) {
+	return c.current().Index(indexName, obj)
+}
+
+func (c *cowMap) IndexKeys(indexName, indexedValue string) ([]string, error) {
+	return c.current().IndexKeys(indexName, indexedValue)
+}
+
+func (c *cowMap) ListIndexFuncValues(indexName string) []string {
+	return c.current().ListIndexFuncValues(indexName)
+}
+
+func (c *cowMap) ByIndex(indexName, indexedValue string) ([]interface{}, error) {
+	return c.current().ByIndex(indexName, indexedValue)
+}
+
+func (c *cowMap) GetIndexers() types.Indexers {
+	return c.current().GetIndexers()
+}
+
+func (c *cowMap) FindCycles() [][]string {
+	return c.current().FindCycles()
+}
+
+func (c *cowMap) TopologicalKeys() ([]string, error) {
+	return c.current().TopologicalKeys()
+}
+
+func (c *cowMap) TopologicalKeysFrom(roots []string) ([]string, error) {
+	return c.current().TopologicalKeysFrom(roots)
+}
+
+// persistentStorage keeps the items and the relations in persistent maps. It
+// modifies in place only what it created since it was last frozen, the rest is
+// copied first.
+type persistentStorage struct {
+	items     pmap
+	relations pmap
+	// owner is the edit of the writer since the storage was last frozen.
+	owner *edit
+}
+
+func newPersistentStorage() *persistentStorage {
+	return &persistentStorage{owner: new(edit)}
+}
+
+// freeze returns a copy of the contents which is never modified, later writes
+// copy whatever they change.
+func (s *persistentStorage) freeze() *persistentStorage {
+	frozen := &persistentStorage{items: s.items, relations: s.relations}
+	s.owner = new(edit)
+	return frozen
+}
+
+func (s *persistentStorage) item(key string) (interface{}, bool) {
+	return s.items.get(key)
+}
+
+func (s *persistentStorage) setItem(key string, obj interface{}) {
+	s.items.set(s.owner, key, obj)
+}
+
+func (s *persistentStorage) deleteItem(key string) {
+	s.items.delete(s.owner, key)
+}
+
+func (s *persistentStorage) relation(key string) *relation {
+	relat, exists := s.relations.get(key)
+	if !exists {
+		return nil
+	}
+	return relat.(*relation)
+}
+
+// edit forks the relation of key unless it was created since the storage was
+// last frozen.
+func (s *persistentStorage) edit(key string) *relation {
+	relat := s.relation(key)
+	if relat == nil || relat.edit == s.owner {
+		return relat
+	}
+	relat = relat.fork(s.owner)
+	s.relations.set(s.owner, key, relat)
+	return relat
+}
+
+func (s *persistentStorage) setRelation(key string, relat *relation) {
+	relat.edit = s.owner
+	s.relations.set(s.owner, key, relat)
+}
+
+func (s *persistentStorage) deleteRelation(key string) {
+	s.relations.delete(s.owner, key)
+}
+
+func (s *persistentStorage) newSet() keySet {
+	return &persistentSet{edit: s.owner}
+}
+
+func (s *persistentStorage) newIndex() index {
+	return &persistentIndex{storage: s}
+}
+
+func (s *persistentStorage) len() int {
+	return s.items.size
+}
+
+func (s *persistentStorage) eachItem(f func(key string, obj interface{})) {
+	s.items.each(f)
+}
+
+func (s *persistentStorage) eachRelation(f func(key string, relat *relation)) {
+	s.relations.each(func(key string, relat interface{}) {
+		f(key, relat.(*relation))
+	})
+}
+
+// empty ignores size, the persistent maps grow by nodes.
+func (s *persistentStorage) empty(size int) storage {
+	return newPersistentStorage()
+}
+
+func (s *persistentStorage) replace(next storage) {
+	*s = *next.(*persistentStorage)
+}
+
+func (s *persistentStorage) view() storage {
+	return s.freeze()
+}
+
+// detach has nothing to do, the views are frozen.
+func (s *persistentStorage) detach() {}
+
+// persistentIndex is the index of the copy-on-write store, it modifies in place
+// only what the writer of its storage created since the storage was last
+// frozen.
+type persistentIndex struct {
+	m       pmap
+	storage *persistentStorage
+}
+
+// freeze returns a copy of idx for the storage frozen, which is never modified.
+func (idx *persistentIndex) freeze(frozen *persistentStorage) *persistentIndex {
+	return &persistentIndex{m: idx.m, storage: frozen}
+}
+
+// edit gives the set of value for the writer to modify, it is created if
+// missing.
+func (idx *persistentIndex) edit(value string) *persistentSet {
+	owner := idx.storage.owner
+	found, exists := idx.m.get(value)
+	if exists && found.(*persistentSet).edit == owner {
+		return found.(*persistentSet)
+	}
+	set := &persistentSet{edit: owner}
+	if exists {
+		set = found.(*persistentSet).fork(owner).(*persistentSet)
+	}
+	idx.m.set(owner, value, set)
+	return set
+}
+
+func (idx *persistentIndex) add(values []string, key string) {
+	for _, value := range values {
+		idx.edit(value).add(key)
+	}
+}
+
+func (idx *persistentIndex) remove(values []string, key string) {
+	for _, value := range values {
+		if _, exists := idx.m.get(value); !exists {
+			continue
+		}
+		set := idx.edit(value)
+		set.remove(key)
+		if set.len() == 0 {
+			idx.m.delete(idx.storage.owner, value)
+		}
+	}
+}
+
+func (idx *persistentIndex) keys(value string) keySet {
+	set, exists := idx.m.get(value)
+	if !exists {
+		return nil
+	}
+	return set.(*persistentSet)
+}
+
+func (idx *persistentIndex) values() []string {
+	values := make([]string, 0, idx.m.size)
+	idx.m.each(func(value string, _ interface{}) {
+		values = append(values, value)
+	})
+	return values
+}
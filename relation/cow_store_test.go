@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/firemiles/go-cache/pkg/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Copy-on-write store", func() {
+	prefixIndex := func(obj interface{}) ([]string, error) {
+		return []string{strings.SplitN(obj.(*Object).ID, "-", 2)[0]}, nil
+	}
+
+	It("Keep snapshots unchanged", func() {
+		store := NewCopyOnWriteMap(ObjectRefers, WithIndexers(types.Indexers{"prefix": prefixIndex}))
+		Expect(store.Add("a-1", newObject("a-1", "b-1"))).ShouldNot(HaveOccurred())
+		Expect(store.Add("b-1", newObject("b-1"))).ShouldNot(HaveOccurred())
+		snapshot := store.Snapshot()
+
+		Expect(store.Update("a-1", newObject("a-1", "b-2"))).ShouldNot(HaveOccurred())
+		Expect(store.Add("a-2", newObject("a-2", "b-1"))).ShouldNot(HaveOccurred())
+		Expect(store.Delete("b-1")).ShouldNot(HaveOccurred())
+
+		Expect(snapshot.ListKeys()).Should(ConsistOf("a-1", "b-1"))
+		Expect(snapshot.ReferencedKeys("b-1")).Should(Equal([]string{"a-1"}))
+		Expect(snapshot.DanglingKeys()).Should(BeEmpty())
+		Expect(snapshot.IndexKeys("prefix", "a")).Should(Equal([]string{"a-1"}))
+		_, version := snapshot.ListWithVersion()
+		Expect(version).Should(Equal(uint64(2)))
+
+		Expect(store.ReferencedKeys("b-1")).Should(Equal([]string{"a-2"}))
+		Expect(store.DanglingKeys()).Should(Equal([]string{"b-1", "b-2"}))
+		Expect(store.IndexKeys("prefix", "a")).Should(Equal([]string{"a-1", "a-2"}))
+	})
+
+	It("Query the indices while a writer holds the lock", func() {
+		store := NewCopyOnWriteMap(ObjectRefers, WithIndexers(types.Indexers{"prefix": prefixIndex}))
+		Expect(store.Add("a-1", newObject("a-1"))).ShouldNot(HaveOccurred())
+		Expect(store.Add("b-1", newObject("b-1"))).ShouldNot(HaveOccurred())
+		Expect(store.Delete("b-1")).ShouldNot(HaveOccurred())
+		cow := store.(*cowMap)
+		cow.lock.Lock()
+		defer cow.unlock()
+
+		Expect(store.IndexKeys("prefix", "a")).Should(Equal([]string{"a-1"}))
+		Expect(store.ByIndex("prefix", "a")).Should(Equal([]interface{}{newObject("a-1")}))
+		Expect(store.ListIndexFuncValues("prefix")).Should(Equal([]string{"a"}))
+		Expect(store.Index("prefix", newObject("a-2"))).Should(Equal([]interface{}{newObject("a-1")}))
+		Expect(store.GetIndexers()).Should(HaveKey("prefix"))
+	})
+
+	It("Reject writes to snapshots", func() {
+		store := NewCopyOnWriteMap(ObjectRefers)
+		snapshot := store.Snapshot()
+		Expect(snapshot.Add("a", newObject("a"))).Should(Equal(ErrReadOnly))
+		Expect(snapshot.Delete("a")).Should(Equal(ErrReadOnly))
+		_, err := snapshot.Replace(nil)
+		Expect(err).Should(Equal(ErrReadOnly))
+		Expect(snapshot.Commit(nil)).Should(Equal(ErrReadOnly))
+		Expect(store.List()).Should(BeEmpty())
+	})
+
+	It("Serve a cache", func() {
+		c := NewCache(ObjectKey, ObjectRefers, WithCopyOnWrite())
+		Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+		Expect(c.ReferencedKeys("b")).Should(Equal([]string{"a"}))
+		Expect(c.Delete(newObject("a"))).ShouldNot(HaveOccurred())
+		Expect(c.ReferencedKeys("b")).Should(BeEmpty())
+	})
+
+	It("Read while writing", func() {
+		store := NewCopyOnWriteMap(ObjectRefers)
+		Expect(store.Add("root", newObject("root"))).ShouldNot(HaveOccurred())
+		done := make(chan struct{})
+		var wait sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wait.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wait.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					snapshot := store.Snapshot()
+					referrers, err := snapshot.ReferencedKeys("root")
+					Expect(err).ShouldNot(HaveOccurred())
+					for _, referrer := range referrers {
+						_, exists := snapshot.Get(referrer)
+						Expect(exists).Should(BeTrue())
+					}
+				}
+			}()
+		}
+		for i := 0; i < 1000; i++ {
+			key := strconv.Itoa(i)
+			Expect(store.Add(key, newObject(key, "root"))).ShouldNot(HaveOccurred())
+			if i%2 == 0 {
+				Expect(store.Delete(key)).ShouldNot(HaveOccurred())
+			}
+		}
+		close(done)
+		wait.Wait()
+		Expect(store.ReferencedKeys("root")).Should(HaveLen(500))
+	})
+})
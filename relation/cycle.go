@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"sort"
+)
+
+func (t *threadSafeMap) FindCycles() [][]string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.findCycles()
+}
+
+// findCycles finds the strongly connected components of the relations with
+// Tarjan's algorithm and keeps the ones containing a cycle.
+func (t *threadSafeMap) findCycles() [][]string {
+	var keys []string
+	t.store.eachRelation(func(key string, _ *relation) {
+		keys = append(keys, key)
+	})
+	sort.Strings(keys)
+
+	var (
+		index   = make(map[string]int, len(keys))
+		lowLink = make(map[string]int, len(keys))
+		onStack = make(map[string]bool)
+		stack   []string
+		cycles  [][]string
+		connect func(key string)
+	)
+	connect = func(key string) {
+		index[key] = len(index)
+		lowLink[key] = index[key]
+		stack = append(stack, key)
+		onStack[key] = true
+
+		selfReferred := false
+		if relat := t.store.relation(key); relat.refers != nil {
+			for _, refKey := range sortedKeys(relat.refers) {
+				if refKey == key {
+					selfReferred = true
+				}
+				if _, visited := index[refKey]; !visited {
+					connect(refKey)
+					if lowLink[refKey] < lowLink[key] {
+						lowLink[key] = lowLink[refKey]
+					}
+				} else if onStack[refKey] && index[refKey] < lowLink[key] {
+					lowLink[key] = index[refKey]
+				}
+			}
+		}
+
+		if lowLink[key] != index[key] {
+			return
+		}
+		var component []string
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component = append(component, top)
+			if top == key {
+				break
+			}
+		}
+		if len(component) > 1 || selfReferred {
+			sort.Strings(component)
+			cycles = append(cycles, component)
+		}
+	}
+	for _, key := range keys {
+		if _, visited := index[key]; !visited {
+			connect(key)
+		}
+	}
+	sort.Slice(cycles, func(i, j int) bool {
+		return cycles[i][0] < cycles[j][0]
+	})
+	return cycles
+}
+
+// cycleThrough returns the shortest cycle key would be part of if it referred to
+// refers, or nil if refers don't lead back to key.
+func (t *threadSafeMap) cycleThrough(key string, refers []Refer) []string {
+	parents := map[string]string{key: ""}
+	level := make([]string, 0, len(refers))
+	for _, refer := range refers {
+		refKey := refer.Key
+		if refKey == key {
+			return []string{key, key}
+		}
+		if _, seen := parents[refKey]; !seen {
+			parents[refKey] = key
+			level = append(level, refKey)
+		}
+	}
+	for len(level) > 0 {
+		var nextLevel []string
+		for _, cur := range level {
+			relat := t.store.relation(cur)
+			if relat == nil || relat.refers == nil {
+				continue
+			}
+			for _, refKey := range sortedKeys(relat.refers) {
+				if refKey == key {
+					return append(pathTo(parents, key, cur), key)
+				}
+				if _, seen := parents[refKey]; !seen {
+					parents[refKey] = cur
+					nextLevel = append(nextLevel, refKey)
+				}
+			}
+		}
+		level = nextLevel
+	}
+	return nil
+}
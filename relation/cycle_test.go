@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reference cycles", func() {
+	It("Find cycles", func() {
+		c := NewCache(ObjectKey, ObjectRefers)
+		for _, obj := range []*Object{
+			newObject("a", "b"), newObject("b", "c"), newObject("c", "a", "d"),
+			newObject("d", "e"), newObject("e", "d"),
+			newObject("f", "f"), newObject("g", "a"),
+		} {
+			Expect(c.Add(obj)).ShouldNot(HaveOccurred())
+		}
+		Expect(c.FindCycles()).Should(Equal([][]string{{"a", "b", "c"}, {"d", "e"}, {"f"}}))
+
+		Expect(c.Update(newObject("c", "d"))).ShouldNot(HaveOccurred())
+		Expect(c.Delete(newObject("f"))).ShouldNot(HaveOccurred())
+		Expect(c.FindCycles()).Should(Equal([][]string{{"d", "e"}}))
+	})
+
+	It("Reject cycles", func() {
+		c := NewCache(ObjectKey, ObjectRefers, WithCycleRejection())
+		Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b", "c", "x"))).ShouldNot(HaveOccurred())
+
+		err := c.Add(newObject("c", "a"))
+		Expect(err).Should(Equal(CycleError{Cycle: []string{"c", "a", "b", "c"}}))
+		_, exists, _ := c.GetByKey("c")
+		Expect(exists).Should(BeFalse())
+
+		Expect(c.Add(newObject("self", "self"))).Should(Equal(CycleError{Cycle: []string{"self", "self"}}))
+		Expect(c.Add(newObject("c", "x"))).ShouldNot(HaveOccurred())
+		Expect(c.Update(newObject("b", "x"))).ShouldNot(HaveOccurred())
+		Expect(c.Update(newObject("c", "a"))).ShouldNot(HaveOccurred())
+		Expect(c.FindCycles()).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+// DeletionPropagation decides what DeleteCascade does with the dependents of an
+// object, that is every object referring to it directly or indirectly.
+type DeletionPropagation int
+
+const (
+	// DeletePropagationOrphan deletes the object only, its dependents are kept
+	// and keep referring to it.
+	DeletePropagationOrphan DeletionPropagation = iota
+	// DeletePropagationForeground deletes the dependents first, each dependent
+	// is deleted before the objects it refers to.
+	DeletePropagationForeground
+	// DeletePropagationBackground deletes the object first, then its dependents
+	// level by level.
+	DeletePropagationBackground
+)
+
+// String gives the name of the propagation.
+func (p DeletionPropagation) String() string {
+	switch p {
+	case DeletePropagationOrphan:
+		return "Orphan"
+	case DeletePropagationForeground:
+		return "Foreground"
+	case DeletePropagationBackground:
+		return "Background"
+	}
+	return "Unknown"
+}
+
+func (t *threadSafeMap) DeleteCascade(key string, propagation DeletionPropagation) ([]string, error) {
+	t.lock.Lock()
+	defer t.unlock()
+
+	if _, exists := t.store.item(key); !exists {
+		return nil, nil
+	}
+
+	var deleted []string
+	switch propagation {
+	case DeletePropagationForeground:
+		deleted = t.foregroundOrder(key, make(map[string]bool), nil)
+	case DeletePropagationBackground:
+		deleted = t.backgroundOrder(key)
+	default:
+		// orphaned dependents keep their references, so strong references
+		// must block the deletion like in Delete.
+		if referrers := t.strongReferrers(key); len(referrers) > 0 {
+			return nil, ReferencedError{Key: key, Referrers: referrers}
+		}
+		if err := t.unblockOwner(key); err != nil {
+			return nil, err
+		}
+		deleted = []string{key}
+	}
+	// Every referrer of a deleted key is deleted too, so no strong reference
+	// can be left behind.
+	var err error
+	for i, k := range deleted {
+		// the keys deleted before the log failed are logged, they stay deleted
+		if err = t.deleteItem(k); err != nil {
+			deleted = deleted[:i]
+			break
+		}
+	}
+	// only the orphans are left to be told
+	for _, k := range deleted {
+		t.notifyReferrers(k, Deleted)
+	}
+	return deleted, err
+}
+
+// foregroundOrder appends key after all of its dependents to order.
+func (t *threadSafeMap) foregroundOrder(key string, visited map[string]bool, order []string) []string {
+	visited[key] = true
+	if relat := t.store.relation(key); relat != nil && relat.referenced != nil {
+		for _, referrer := range sortedKeys(relat.referenced) {
+			if !visited[referrer] {
+				order = t.foregroundOrder(referrer, visited, order)
+			}
+		}
+	}
+	return append(order, key)
+}
+
+// backgroundOrder lists key followed by its dependents in breadth first order.
+func (t *threadSafeMap) backgroundOrder(key string) []string {
+	visited := map[string]bool{key: true}
+	order := []string{key}
+	for i := 0; i < len(order); i++ {
+		relat := t.store.relation(order[i])
+		if relat == nil || relat.referenced == nil {
+			continue
+		}
+		for _, referrer := range sortedKeys(relat.referenced) {
+			if !visited[referrer] {
+				visited[referrer] = true
+				order = append(order, referrer)
+			}
+		}
+	}
+	return order
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Delete cascade", func() {
+	var c Cache
+	root := &Object{ID: "root"}
+	a := &Object{ID: "a", SubObjects: []*Object{root}}
+	b := &Object{ID: "b", SubObjects: []*Object{a}}
+	d := &Object{ID: "d", SubObjects: []*Object{root}}
+	other := &Object{ID: "other"}
+
+	BeforeEach(func() {
+		c = NewCache(ObjectKey, ObjectRefers, WithStrongReferences())
+		for _, obj := range []*Object{root, a, b, d, other} {
+			Expect(c.Add(obj)).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("Orphan", func() {
+		_, err := c.DeleteCascade(root, DeletePropagationOrphan)
+		Expect(err).Should(Equal(ReferencedError{Key: root.ID, Referrers: []string{a.ID, d.ID}}))
+		deleted, err := c.DeleteCascade(b, DeletePropagationOrphan)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deleted).Should(Equal([]string{b.ID}))
+		Expect(c.ListKeys()).Should(ConsistOf(root.ID, a.ID, d.ID, other.ID))
+	})
+
+	It("Foreground", func() {
+		deleted, err := c.DeleteCascade(root, DeletePropagationForeground)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deleted).Should(Equal([]string{b.ID, a.ID, d.ID, root.ID}))
+		Expect(c.ListKeys()).Should(Equal([]string{other.ID}))
+	})
+
+	It("Background", func() {
+		deleted, err := c.DeleteCascade(root, DeletePropagationBackground)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deleted).Should(Equal([]string{root.ID, a.ID, d.ID, b.ID}))
+		Expect(c.ListKeys()).Should(Equal([]string{other.ID}))
+	})
+
+	It("Missing object", func() {
+		deleted, err := c.DeleteCascade(&Object{ID: "missing"}, DeletePropagationForeground)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deleted).Should(BeEmpty())
+	})
+
+	It("Reference cycle", func() {
+		x := &Object{ID: "x"}
+		y := &Object{ID: "y", SubObjects: []*Object{x}}
+		x.SubObjects = []*Object{y}
+		Expect(c.Add(x)).ShouldNot(HaveOccurred())
+		Expect(c.Add(y)).ShouldNot(HaveOccurred())
+		deleted, err := c.DeleteCascade(x, DeletePropagationForeground)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(deleted).Should(Equal([]string{y.ID, x.ID}))
+	})
+})
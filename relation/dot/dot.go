@@ -0,0 +1,291 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+// Package dot writes the reference graph of a relation.Cache in the Graphviz
+// DOT language, e.g. to render it with `dot -Tsvg`.
+package dot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/firemiles/go-cache/relation"
+)
+
+// Option configures Write.
+type Option func(o *options)
+
+type options struct {
+	// label gives the label of a node, obj is nil for a dangling key.
+	label func(key string, obj interface{}) string
+	// root is the key the graph is limited to, along with the keys it refers
+	// to directly or indirectly, if set.
+	root     string
+	hasRoot  bool
+	maxDepth int
+	// highlightDangling draws the dangling keys and the references to them in
+	// red.
+	highlightDangling bool
+	// clusterIndex is the index the nodes are clustered by, if set.
+	clusterIndex string
+}
+
+// WithLabel labels the nodes with label instead of their key, obj is nil for
+// the dangling keys.
+func WithLabel(label func(key string, obj interface{}) string) Option {
+	return func(o *options) {
+		o.label = label
+	}
+}
+
+// WithRoot limits the graph to key and the keys it refers to directly or
+// indirectly, following at most maxDepth references if maxDepth is positive.
+func WithRoot(key string, maxDepth int) Option {
+	return func(o *options) {
+		o.root = key
+		o.hasRoot = true
+		o.maxDepth = maxDepth
+	}
+}
+
+// WithDanglingHighlighted draws in red the keys referred to but not stored, and
+// the references to them.
+func WithDanglingHighlighted() Option {
+	return func(o *options) {
+		o.highlightDangling = true
+	}
+}
+
+// WithClusters groups the nodes by their value in the index indexName, a node
+// indexed with several values is drawn in the cluster of the first one.
+func WithClusters(indexName string) Option {
+	return func(o *options) {
+		o.clusterIndex = indexName
+	}
+}
+
+// Write writes the objects of c as nodes and their references as edges, from
+// the referrer to the referent and labelled with the refer kinds. The graph is
+// drawn from a snapshot of c, nothing is written if it fails.
+func Write(w io.Writer, c relation.Cache, opts ...Option) error {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	snapshot := c.Snapshot()
+	defer snapshot.Release()
+
+	g, err := newGraph(snapshot, o)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	g.write(&buf)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// graph is the part of the reference graph to draw.
+type graph struct {
+	options *options
+	// keys are the keys of the nodes in order.
+	keys    []string
+	objects map[string]interface{}
+	// refers maps a stored key to its refers drawn.
+	refers map[string][]relation.Refer
+	// clusters maps an index value to the keys drawn in its cluster.
+	clusters     map[string][]string
+	clusterOrder []string
+}
+
+func newGraph(c relation.Cache, o *options) (*graph, error) {
+	g := &graph{options: o, objects: make(map[string]interface{}), refers: make(map[string][]relation.Refer)}
+	keys, err := g.nodes(c)
+	if err != nil {
+		return nil, err
+	}
+	drawn := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		drawn[key] = true
+	}
+	for _, key := range keys {
+		obj, exists, err := c.GetByKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		g.objects[key] = obj
+		refers, err := c.Refers(key)
+		if err != nil {
+			return nil, err
+		}
+		for _, refer := range refers {
+			if drawn[refer.Key] {
+				g.refers[key] = append(g.refers[key], refer)
+			}
+		}
+	}
+	g.keys = keys
+	if o.clusterIndex != "" {
+		if err := g.cluster(c, drawn); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// nodes lists in order the keys to draw.
+func (g *graph) nodes(c relation.Cache) ([]string, error) {
+	if !g.options.hasRoot {
+		keys := append(c.ListKeys(), c.DanglingKeys()...)
+		sort.Strings(keys)
+		return keys, nil
+	}
+	if _, exists, err := c.GetByKey(g.options.root); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, fmt.Errorf("root %s not found", g.options.root)
+	}
+	reached, err := c.TransitiveReferKeys(g.options.root, g.options.maxDepth)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{g.options.root}
+	for _, r := range reached {
+		if r.Key != g.options.root {
+			keys = append(keys, r.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// cluster groups the drawn keys by their first value in the cluster index.
+func (g *graph) cluster(c relation.Cache, drawn map[string]bool) error {
+	if _, exists := c.GetIndexers()[g.options.clusterIndex]; !exists {
+		return fmt.Errorf("index %s does not exist", g.options.clusterIndex)
+	}
+	values := c.ListIndexFuncValues(g.options.clusterIndex)
+	sort.Strings(values)
+	clustered := make(map[string]bool)
+	g.clusters = make(map[string][]string)
+	for _, value := range values {
+		keys, err := c.IndexKeys(g.options.clusterIndex, value)
+		if err != nil {
+			return err
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if drawn[key] && !clustered[key] {
+				clustered[key] = true
+				g.clusters[value] = append(g.clusters[value], key)
+			}
+		}
+		if len(g.clusters[value]) > 0 {
+			g.clusterOrder = append(g.clusterOrder, value)
+		}
+	}
+	unclustered := g.keys[:0:0]
+	for _, key := range g.keys {
+		if !clustered[key] {
+			unclustered = append(unclustered, key)
+		}
+	}
+	g.keys = unclustered
+	return nil
+}
+
+func (g *graph) write(w *bytes.Buffer) {
+	w.WriteString("digraph relations {\n")
+	for i, value := range g.clusterOrder {
+		fmt.Fprintf(w, "\tsubgraph %s {\n", quote(fmt.Sprintf("cluster_%d", i)))
+		fmt.Fprintf(w, "\t\tlabel=%s;\n", quote(value))
+		for _, key := range g.clusters[value] {
+			g.writeNode(w, "\t\t", key)
+		}
+		w.WriteString("\t}\n")
+	}
+	for _, key := range g.keys {
+		g.writeNode(w, "\t", key)
+	}
+	referrers := make([]string, 0, len(g.refers))
+	for key := range g.refers {
+		referrers = append(referrers, key)
+	}
+	sort.Strings(referrers)
+	for _, key := range referrers {
+		g.writeEdges(w, key)
+	}
+	w.WriteString("}\n")
+}
+
+func (g *graph) writeNode(w *bytes.Buffer, indent string, key string) {
+	obj, stored := g.objects[key]
+	label := key
+	if g.options.label != nil {
+		label = g.options.label(key, obj)
+	}
+	attrs := []string{"label=" + quote(label)}
+	if !stored && g.options.highlightDangling {
+		attrs = append(attrs, "style=dashed", "color=red", "fontcolor=red")
+	}
+	fmt.Fprintf(w, "%s%s [%s];\n", indent, quote(key), strings.Join(attrs, ", "))
+}
+
+// writeEdges writes one edge per key referred to by key, labelled with the
+// kinds of the refers other than the default one.
+func (g *graph) writeEdges(w *bytes.Buffer, key string) {
+	refers := g.refers[key]
+	for i := 0; i < len(refers); {
+		refKey := refers[i].Key
+		var kinds []string
+		for ; i < len(refers) && refers[i].Key == refKey; i++ {
+			if refers[i].Kind != relation.DefaultReferKind {
+				kinds = append(kinds, refers[i].Kind)
+			}
+		}
+		var attrs []string
+		if len(kinds) > 0 {
+			attrs = append(attrs, "label="+quote(strings.Join(kinds, ", ")))
+		}
+		if _, stored := g.objects[refKey]; !stored && g.options.highlightDangling {
+			attrs = append(attrs, "style=dashed", "color=red")
+		}
+		fmt.Fprintf(w, "\t%s -> %s", quote(key), quote(refKey))
+		if len(attrs) > 0 {
+			fmt.Fprintf(w, " [%s]", strings.Join(attrs, ", "))
+		}
+		w.WriteString(";\n")
+	}
+}
+
+// quote makes s a DOT quoted string.
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package dot
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/firemiles/go-cache/pkg/types"
+	"github.com/firemiles/go-cache/relation"
+)
+
+type node struct {
+	Name   string
+	Zone   string
+	Refers []relation.Refer
+}
+
+func nodeKey(obj interface{}) (string, error) {
+	return obj.(*node).Name, nil
+}
+
+func nodeRefers(obj interface{}) ([]relation.Refer, error) {
+	return obj.(*node).Refers, nil
+}
+
+func zoneIndex(obj interface{}) ([]string, error) {
+	if zone := obj.(*node).Zone; zone != "" {
+		return []string{zone}, nil
+	}
+	return nil, nil
+}
+
+func TestDot(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "DOT Suite")
+}
+
+var _ = Describe("DOT", func() {
+	var c relation.Cache
+	n := func(name, zone string, refers ...string) *node {
+		obj := &node{Name: name, Zone: zone}
+		for _, refer := range refers {
+			key, kind := refer, relation.DefaultReferKind
+			if i := strings.Index(refer, ":"); i >= 0 {
+				key, kind = refer[:i], refer[i+1:]
+			}
+			obj.Refers = append(obj.Refers, relation.Refer{Key: key, Kind: kind})
+		}
+		return obj
+	}
+	write := func(opts ...Option) string {
+		var buf bytes.Buffer
+		Expect(Write(&buf, c, opts...)).ShouldNot(HaveOccurred())
+		return buf.String()
+	}
+
+	BeforeEach(func() {
+		c = relation.NewCache(nodeKey, nil,
+			relation.WithTypedReferFunc(nodeRefers),
+			relation.WithIndexers(types.Indexers{"zone": zoneIndex}))
+		for _, obj := range []*node{
+			n("app", "east", "db:owner", "db", "cfg"),
+			n("db", "east", "disk"),
+			n("disk", "west"),
+			n("web", "", "app", "lost"),
+		} {
+			Expect(c.Add(obj)).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("Write the objects and their references", func() {
+		Expect(write()).Should(Equal(`digraph relations {
+	"app" [label="app"];
+	"cfg" [label="cfg"];
+	"db" [label="db"];
+	"disk" [label="disk"];
+	"lost" [label="lost"];
+	"web" [label="web"];
+	"app" -> "cfg";
+	"app" -> "db" [label="owner"];
+	"db" -> "disk";
+	"web" -> "app";
+	"web" -> "lost";
+}
+`))
+	})
+
+	It("Label the nodes and highlight the dangling keys", func() {
+		label := func(key string, obj interface{}) string {
+			if obj == nil {
+				return key + "\n(missing)"
+			}
+			return `"` + key + `"`
+		}
+		Expect(write(WithLabel(label), WithDanglingHighlighted(), WithRoot("web", 0))).Should(Equal(`digraph relations {
+	"app" [label="\"app\""];
+	"cfg" [label="cfg\n(missing)", style=dashed, color=red, fontcolor=red];
+	"db" [label="\"db\""];
+	"disk" [label="\"disk\""];
+	"lost" [label="lost\n(missing)", style=dashed, color=red, fontcolor=red];
+	"web" [label="\"web\""];
+	"app" -> "cfg" [style=dashed, color=red];
+	"app" -> "db" [label="owner"];
+	"db" -> "disk";
+	"web" -> "app";
+	"web" -> "lost" [style=dashed, color=red];
+}
+`))
+	})
+
+	It("Limit the graph to a root and a depth", func() {
+		Expect(write(WithRoot("app", 1))).Should(Equal(`digraph relations {
+	"app" [label="app"];
+	"cfg" [label="cfg"];
+	"db" [label="db"];
+	"app" -> "cfg";
+	"app" -> "db" [label="owner"];
+}
+`))
+		var buf bytes.Buffer
+		Expect(Write(&buf, c, WithRoot("cfg", 0))).Should(HaveOccurred())
+		Expect(buf.Len()).Should(BeZero())
+	})
+
+	It("Cluster the nodes by an index value", func() {
+		Expect(write(WithClusters("zone"), WithRoot("app", 0))).Should(Equal(`digraph relations {
+	subgraph "cluster_0" {
+		label="east";
+		"app" [label="app"];
+		"db" [label="db"];
+	}
+	subgraph "cluster_1" {
+		label="west";
+		"disk" [label="disk"];
+	}
+	"cfg" [label="cfg"];
+	"app" -> "cfg";
+	"app" -> "db" [label="owner"];
+	"db" -> "disk";
+}
+`))
+		var buf bytes.Buffer
+		Expect(Write(&buf, c, WithClusters("missing"))).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RefersError will be returned any time a ReferFunc gives an error; it includes the
+// object at fault.
+type RefersError struct {
+	Key string
+	Obj interface{}
+	Err error
+}
+
+// Error gives a human-readable description of the error.
+func (r RefersError) Error() string {
+	return fmt.Sprintf("couldn't calculate refers for object %q %+v: %v", r.Key, r.Obj, r.Err)
+}
+
+// ReferencedError will be returned when deleting an object which is still strongly
+// referenced; it includes the referrers blocking the deletion.
+type ReferencedError struct {
+	Key       string
+	Referrers []string
+}
+
+// Error gives a human-readable description of the error.
+func (r ReferencedError) Error() string {
+	return fmt.Sprintf("object %q is still referenced by %s", r.Key, strings.Join(r.Referrers, ", "))
+}
+
+// OwnerBlockedError will be returned when deleting an owner whose dependents
+// referring to it with BlockingOwnerReferKind can't be collected; it includes
+// the dependents blocking the deletion.
+type OwnerBlockedError struct {
+	Key        string
+	Dependents []string
+}
+
+// Error gives a human-readable description of the error.
+func (o OwnerBlockedError) Error() string {
+	return fmt.Sprintf("deletion of owner %q is blocked by %s", o.Key, strings.Join(o.Dependents, ", "))
+}
+
+// CycleError will be returned when references would form a cycle, or when no
+// order exists because of one; it includes the keys along the cycle, the first
+// key being repeated at the end.
+type CycleError struct {
+	Cycle []string
+}
+
+// Error gives a human-readable description of the error.
+func (c CycleError) Error() string {
+	return fmt.Sprintf("reference cycle %s", strings.Join(c.Cycle, " -> "))
+}
+
+// ConflictError will be returned when updating an object whose version isn't the
+// expected one anymore; it includes both versions, a version of 0 stands for no
+// object.
+type ConflictError struct {
+	Key      string
+	Expected uint64
+	Actual   uint64
+}
+
+// Error gives a human-readable description of the error.
+func (c ConflictError) Error() string {
+	return fmt.Sprintf("object %q is at version %d, expected version %d", c.Key, c.Actual, c.Expected)
+}
+
+// SnapshotFormatError will be returned when loading data which isn't a valid
+// snapshot for the cache; it tells what is wrong with the data.
+type SnapshotFormatError struct {
+	Reason string
+}
+
+// Error gives a human-readable description of the error.
+func (s SnapshotFormatError) Error() string {
+	return fmt.Sprintf("invalid snapshot: %s", s.Reason)
+}
@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"reflect"
+)
+
+// evictor keeps a store within its bounds, its state is guarded by the write
+// lock of the store.
+type evictor struct {
+	policy     EvictionPolicy
+	maxObjects int
+	maxBytes   int64
+	sizeOf     func(obj interface{}) int64
+	// protectReferenced keeps the objects other stored objects refer to.
+	protectReferenced bool
+
+	// sizes maps a key to the size of its object, if maxBytes is set.
+	sizes map[string]int64
+	bytes int64
+}
+
+func newEvictor(o *options) *evictor {
+	if o.maxObjects <= 0 && o.maxBytes <= 0 {
+		return nil
+	}
+	e := &evictor{
+		policy:            o.evictionPolicy,
+		maxObjects:        o.maxObjects,
+		protectReferenced: o.protectReferenced,
+	}
+	if e.policy == nil {
+		e.policy = NewLRUPolicy()
+	}
+	if o.maxBytes > 0 {
+		e.maxBytes = o.maxBytes
+		e.sizeOf = o.sizeOf
+		if e.sizeOf == nil {
+			e.sizeOf = sizeOfValue
+		}
+		e.sizes = make(map[string]int64)
+	}
+	return e
+}
+
+// sizeOfValue estimates the memory held by obj in bytes, following its
+// pointers, slices, maps and strings, what it shares is counted once. It sizes
+// the objects of WithMaxBytes by default.
+func sizeOfValue(obj interface{}) int64 {
+	if obj == nil {
+		return 0
+	}
+	v := reflect.ValueOf(obj)
+	return int64(v.Type().Size()) + sizeOfReferents(v, make(map[uintptr]bool))
+}
+
+// sizeOfReferents sums the sizes of what v refers to, seen holds the addresses
+// already counted.
+func sizeOfReferents(v reflect.Value, seen map[uintptr]bool) int64 {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		return int64(v.Type().Elem().Size()) + sizeOfReferents(v.Elem(), seen)
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		return int64(v.Elem().Type().Size()) + sizeOfReferents(v.Elem(), seen)
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Slice:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		size := int64(v.Cap()) * int64(v.Type().Elem().Size())
+		for i := 0; i < v.Len(); i++ {
+			size += sizeOfReferents(v.Index(i), seen)
+		}
+		return size
+	case reflect.Array:
+		var size int64
+		for i := 0; i < v.Len(); i++ {
+			size += sizeOfReferents(v.Index(i), seen)
+		}
+		return size
+	case reflect.Map:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		entry := int64(v.Type().Key().Size() + v.Type().Elem().Size())
+		var size int64
+		for iter := v.MapRange(); iter.Next(); {
+			size += entry + sizeOfReferents(iter.Key(), seen) + sizeOfReferents(iter.Value(), seen)
+		}
+		return size
+	case reflect.Struct:
+		var size int64
+		for i := 0; i < v.NumField(); i++ {
+			size += sizeOfReferents(v.Field(i), seen)
+		}
+		return size
+	}
+	return 0
+}
+
+// over tells if count objects of the given size exceed the bounds.
+func (e *evictor) over(count int, bytes int64) bool {
+	return (e.maxObjects > 0 && count > e.maxObjects) || (e.maxBytes > 0 && bytes > e.maxBytes)
+}
+
+func (e *evictor) put(key string, obj interface{}, existed bool) {
+	if existed {
+		e.policy.Access(key)
+	} else {
+		e.policy.Add(key)
+	}
+	if e.sizes != nil {
+		size := e.sizeOf(obj)
+		e.bytes += size - e.sizes[key]
+		e.sizes[key] = size
+	}
+}
+
+func (e *evictor) remove(key string) {
+	e.policy.Remove(key)
+	if e.sizes != nil {
+		e.bytes -= e.sizes[key]
+		delete(e.sizes, key)
+	}
+}
+
+// replaced accounts for the contents swapped in by Replace.
+func (e *evictor) replaced(items map[string]interface{}, delta ReplaceDelta) {
+	for _, key := range delta.Removed {
+		e.remove(key)
+	}
+	for _, key := range delta.Added {
+		e.put(key, items[key], false)
+	}
+	for _, key := range delta.Changed {
+		e.put(key, items[key], true)
+	}
+}
+
+// accessed tells the policy key was read.
+func (t *threadSafeMap) accessed(key string) {
+	if t.evictor != nil {
+		t.evictor.policy.Access(key)
+	}
+}
+
+// evict evicts objects in the order of the policy until the store is within
+// its bounds, the keys just written are kept. The caller holds the write lock.
+func (t *threadSafeMap) evict(written ...string) {
+	e := t.evictor
+	if e == nil {
+		return
+	}
+	keep := make(map[string]bool, len(written))
+	for _, key := range written {
+		keep[key] = true
+	}
+	// evicting an object may leave the ones it referred to unprotected
+	for progress := true; progress && e.over(t.store.len(), e.bytes); {
+		count, bytes := t.store.len(), e.bytes
+		var victims []string
+		e.policy.Victims(func(key string) bool {
+			if keep[key] || t.isProtected(key) {
+				return true
+			}
+			victims = append(victims, key)
+			count--
+			bytes -= e.sizes[key]
+			return e.over(count, bytes)
+		})
+		progress = false
+		for _, key := range victims {
+			if !t.isProtected(key) && t.evictItem(key) {
+				progress = true
+			}
+		}
+	}
+}
+
+// isProtected tells if key can't be evicted because of the objects referring
+// to it.
+func (t *threadSafeMap) isProtected(key string) bool {
+	if t.evictor.protectReferenced {
+		if relat := t.store.relation(key); relat.referenced != nil && relat.referenced.len() > 0 {
+			return true
+		}
+	}
+	return len(t.strongReferrers(key)) > 0
+}
+
+// evictItem evicts key and reports it, the caller checks it exists. It tells
+// if key is gone, it stays if the log failed.
+func (t *threadSafeMap) evictItem(key string) bool {
+	if t.log(walRecord{op: walDelete, key: key}) != nil {
+		return false
+	}
+	obj, _ := t.store.item(key)
+	t.evictor.policy.Evict(key)
+	t.removeItem(key)
+	t.broadcaster.publish(Event{Type: Evicted, Key: key, Object: obj})
+	t.notifyReferrers(key, Evicted)
+	return true
+}
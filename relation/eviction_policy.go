@@ -0,0 +1,357 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"container/list"
+	"sync"
+)
+
+// EvictionPolicy picks the objects to evict from a cache over its bounds, see
+// WithMaxObjects and WithMaxBytes. Its methods may be called concurrently.
+type EvictionPolicy interface {
+	// Add records that key was stored.
+	Add(key string)
+	// Access records that key was read or updated, unknown keys are ignored.
+	Access(key string)
+	// Remove forgets key, which was deleted.
+	Remove(key string)
+	// Evict forgets key, which was evicted. The policy may remember it to
+	// adapt to the workload.
+	Evict(key string)
+	// Victims calls next with the stored keys, from the first to evict on,
+	// until next returns false. next doesn't call the policy.
+	Victims(next func(key string) bool)
+}
+
+// lruPolicy evicts the least recently used keys first.
+type lruPolicy struct {
+	lock    sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// NewLRUPolicy returns an EvictionPolicy evicting the least recently used
+// objects first.
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (p *lruPolicy) Add(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if e, exists := p.entries[key]; exists {
+		p.order.MoveToFront(e)
+		return
+	}
+	p.entries[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) Access(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if e, exists := p.entries[key]; exists {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Remove(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if e, exists := p.entries[key]; exists {
+		p.order.Remove(e)
+		delete(p.entries, key)
+	}
+}
+
+func (p *lruPolicy) Evict(key string) {
+	p.Remove(key)
+}
+
+func (p *lruPolicy) Victims(next func(key string) bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for e := p.order.Back(); e != nil; e = e.Prev() {
+		if !next(e.Value.(string)) {
+			return
+		}
+	}
+}
+
+// lfuPolicy evicts the least frequently used keys first, the least recently
+// used first among keys used as often. Keys are kept in buckets of the same
+// frequency, in increasing order.
+type lfuPolicy struct {
+	lock    sync.Mutex
+	buckets *list.List
+	entries map[string]*lfuEntry
+}
+
+type lfuBucket struct {
+	freq uint64
+	keys *list.List
+}
+
+type lfuEntry struct {
+	bucket *list.Element
+	key    *list.Element
+}
+
+// NewLFUPolicy returns an EvictionPolicy evicting the least frequently used
+// objects first.
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{buckets: list.New(), entries: make(map[string]*lfuEntry)}
+}
+
+func (p *lfuPolicy) Add(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, exists := p.entries[key]; exists {
+		p.access(key)
+		return
+	}
+	first := p.buckets.Front()
+	if first == nil || first.Value.(*lfuBucket).freq != 1 {
+		first = p.buckets.PushFront(&lfuBucket{freq: 1, keys: list.New()})
+	}
+	p.entries[key] = &lfuEntry{bucket: first, key: first.Value.(*lfuBucket).keys.PushFront(key)}
+}
+
+func (p *lfuPolicy) Access(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, exists := p.entries[key]; exists {
+		p.access(key)
+	}
+}
+
+// access moves key to the bucket of the next frequency.
+func (p *lfuPolicy) access(key string) {
+	entry := p.entries[key]
+	bucket := entry.bucket.Value.(*lfuBucket)
+	next := entry.bucket.Next()
+	if next == nil || next.Value.(*lfuBucket).freq != bucket.freq+1 {
+		next = p.buckets.InsertAfter(&lfuBucket{freq: bucket.freq + 1, keys: list.New()}, entry.bucket)
+	}
+	p.unlink(entry)
+	entry.bucket = next
+	entry.key = next.Value.(*lfuBucket).keys.PushFront(key)
+}
+
+// unlink takes entry out of its bucket, dropping the bucket if it is empty.
+func (p *lfuPolicy) unlink(entry *lfuEntry) {
+	bucket := entry.bucket.Value.(*lfuBucket)
+	bucket.keys.Remove(entry.key)
+	if bucket.keys.Len() == 0 {
+		p.buckets.Remove(entry.bucket)
+	}
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if entry, exists := p.entries[key]; exists {
+		p.unlink(entry)
+		delete(p.entries, key)
+	}
+}
+
+func (p *lfuPolicy) Evict(key string) {
+	p.Remove(key)
+}
+
+func (p *lfuPolicy) Victims(next func(key string) bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for b := p.buckets.Front(); b != nil; b = b.Next() {
+		keys := b.Value.(*lfuBucket).keys
+		for e := keys.Back(); e != nil; e = e.Prev() {
+			if !next(e.Value.(string)) {
+				return
+			}
+		}
+	}
+}
+
+// arcPolicy is an adaptive replacement cache policy. Keys used once are in
+// recent, keys used again in frequent, both in LRU order. The keys evicted
+// from them are remembered in the ghost lists recentGhosts and
+// frequentGhosts, storing a key again moves target, the size recent aims for,
+// toward the list it was evicted from.
+type arcPolicy struct {
+	lock     sync.Mutex
+	capacity int
+	target   int
+
+	recent, frequent             *list.List
+	recentGhosts, frequentGhosts *list.List
+	// entries maps a key to its place in one of the four lists.
+	entries map[string]arcEntry
+}
+
+type arcEntry struct {
+	list *list.List
+	elem *list.Element
+}
+
+// NewARCPolicy returns an adaptive replacement EvictionPolicy balancing between
+// the recently and the frequently used objects, capacity is the number of
+// objects the cache holds about, it bounds the evicted keys remembered.
+func NewARCPolicy(capacity int) EvictionPolicy {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &arcPolicy{
+		capacity:       capacity,
+		recent:         list.New(),
+		frequent:       list.New(),
+		recentGhosts:   list.New(),
+		frequentGhosts: list.New(),
+		entries:        make(map[string]arcEntry),
+	}
+}
+
+func (p *arcPolicy) push(l *list.List, key string) {
+	p.entries[key] = arcEntry{list: l, elem: l.PushFront(key)}
+}
+
+func (p *arcPolicy) drop(key string) {
+	entry := p.entries[key]
+	entry.list.Remove(entry.elem)
+	delete(p.entries, key)
+}
+
+// resident tells if key is stored, not only remembered as evicted.
+func (p *arcPolicy) resident(key string) bool {
+	entry, exists := p.entries[key]
+	return exists && (entry.list == p.recent || entry.list == p.frequent)
+}
+
+func (p *arcPolicy) Add(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	entry, exists := p.entries[key]
+	if !exists {
+		p.push(p.recent, key)
+		p.trimGhosts()
+		return
+	}
+	switch entry.list {
+	case p.recentGhosts:
+		p.target += adaptStep(p.frequentGhosts.Len(), p.recentGhosts.Len())
+		if p.target > p.capacity {
+			p.target = p.capacity
+		}
+	case p.frequentGhosts:
+		p.target -= adaptStep(p.recentGhosts.Len(), p.frequentGhosts.Len())
+		if p.target < 0 {
+			p.target = 0
+		}
+	}
+	p.drop(key)
+	p.push(p.frequent, key)
+}
+
+// adaptStep is how much the target moves toward the ghost list of length
+// hit, the other one being of length other.
+func adaptStep(other, hit int) int {
+	if other > hit {
+		return other / hit
+	}
+	return 1
+}
+
+// trimGhosts forgets the oldest evicted keys beyond capacity.
+func (p *arcPolicy) trimGhosts() {
+	for p.recent.Len()+p.recentGhosts.Len() > p.capacity && p.recentGhosts.Len() > 0 {
+		p.drop(p.recentGhosts.Back().Value.(string))
+	}
+	for p.recentGhosts.Len()+p.frequentGhosts.Len() > p.capacity && p.frequentGhosts.Len() > 0 {
+		p.drop(p.frequentGhosts.Back().Value.(string))
+	}
+}
+
+func (p *arcPolicy) Access(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.resident(key) {
+		p.drop(key)
+		p.push(p.frequent, key)
+	}
+}
+
+func (p *arcPolicy) Remove(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.resident(key) {
+		p.drop(key)
+	}
+}
+
+func (p *arcPolicy) Evict(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	entry, exists := p.entries[key]
+	if !exists {
+		return
+	}
+	switch entry.list {
+	case p.recent:
+		p.drop(key)
+		p.push(p.recentGhosts, key)
+	case p.frequent:
+		p.drop(key)
+		p.push(p.frequentGhosts, key)
+	}
+	p.trimGhosts()
+}
+
+// Victims starts with recent if it is over its target size, with frequent
+// otherwise.
+func (p *arcPolicy) Victims(next func(key string) bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	first, second := p.frequent, p.recent
+	if p.recent.Len() > 0 && p.recent.Len() > p.target {
+		first, second = p.recent, p.frequent
+	}
+	for _, l := range []*list.List{first, second} {
+		for e := l.Back(); e != nil; e = e.Prev() {
+			if !next(e.Value.(string)) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Eviction", func() {
+	get := func(c Cache, key string) {
+		_, exists, err := c.GetByKey(key)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(exists).Should(BeTrue())
+	}
+	victims := func(policy EvictionPolicy) []string {
+		var keys []string
+		policy.Victims(func(key string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		return keys
+	}
+
+	forEachEngine(func(name string, opts []Option) {
+		It("Evict the least recently used objects of a "+name, func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c := NewCache(ObjectKey, ObjectRefers, append(opts, WithMaxObjects(3))...)
+			Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(newObject("b", "c"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(newObject("c"))).ShouldNot(HaveOccurred())
+			get(c, "a")
+			events, err := c.Watch(ctx, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(c.Add(newObject("d"))).ShouldNot(HaveOccurred())
+			Expect((<-events).Type).Should(Equal(Added))
+			Expect(<-events).Should(Equal(Event{Type: Evicted, Key: "b", Object: newObject("b", "c"), Version: 5}))
+			Expect(c.ListKeys()).Should(ConsistOf("a", "c", "d"))
+			Expect(c.DanglingKeys()).Should(Equal([]string{"b"}))
+			Expect(c.ReferencedKeys("c")).Should(BeEmpty())
+		})
+	})
+
+	It("Keep the referenced objects if asked to", func() {
+		c := NewCache(ObjectKey, ObjectRefers, WithMaxObjects(2), WithReferencedProtected())
+		Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("c"))).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(ConsistOf("b", "c"))
+	})
+
+	It("Never evict strongly referenced objects", func() {
+		c := NewCache(ObjectKey, ObjectRefers, WithMaxObjects(1), WithStrongReferences())
+		Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(ConsistOf("a", "b"))
+
+		// evicting a leaves b unprotected
+		Expect(c.Add(newObject("c"))).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(Equal([]string{"c"}))
+	})
+
+	It("Bound the estimated size", func() {
+		size := func(obj interface{}) int64 {
+			return int64(len(obj.(*Object).ID))
+		}
+		c := NewCache(ObjectKey, ObjectRefers, WithMaxBytes(5, size))
+		Expect(c.Add(newObject("aa"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("bb"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("c"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("dd"))).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(ConsistOf("bb", "c", "dd"))
+		Expect(c.Replace([]interface{}{newObject("eee"), newObject("ff"), newObject("g")})).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(HaveLen(2))
+	})
+
+	It("Estimate the sizes when no sizer is given", func() {
+		Expect(sizeOfValue(newObject("abcd")) - sizeOfValue(newObject("ab"))).Should(Equal(int64(2)))
+		shared := &Object{ID: "shared"}
+		once := &Object{ID: "a", SubObjects: []*Object{shared, {ID: "b"}}}
+		twice := &Object{ID: "a", SubObjects: []*Object{shared, shared}}
+		Expect(sizeOfValue(once) - sizeOfValue(twice)).Should(Equal(sizeOfValue(Object{ID: "b"})))
+
+		c := NewCache(ObjectKey, ObjectRefers, WithMaxBytes(2*sizeOfValue(newObject("a")), nil))
+		Expect(c.Add(newObject("a"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("c"))).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(ConsistOf("b", "c"))
+	})
+
+	It("Evict the least frequently used objects", func() {
+		c := NewCache(ObjectKey, ObjectRefers, WithMaxObjects(2), WithEvictionPolicy(NewLFUPolicy()))
+		Expect(c.Add(newObject("a"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+		get(c, "a")
+		get(c, "a")
+		get(c, "b")
+		Expect(c.Add(newObject("c"))).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(ConsistOf("a", "c"))
+	})
+
+	It("Adapt the ARC policy to the evicted keys used again", func() {
+		policy := NewARCPolicy(2)
+		policy.Add("a")
+		policy.Add("b")
+		policy.Access("a")
+		Expect(victims(policy)).Should(Equal([]string{"b", "a"}))
+
+		policy.Evict("b")
+		Expect(victims(policy)).Should(Equal([]string{"a"}))
+		// b was evicted too early, recent grows
+		policy.Add("b")
+		policy.Add("c")
+		Expect(victims(policy)).Should(Equal([]string{"a", "b", "c"}))
+		policy.Remove("a")
+		Expect(victims(policy)).Should(Equal([]string{"b", "c"}))
+	})
+})
@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/firemiles/go-cache/pkg/types"
+)
+
+// gcEnabled tells if objects may be collected, once marked, picked by
+// WithCollectable or owned.
+func (t *threadSafeMap) gcEnabled() bool {
+	return t.options.ownerGC || t.options.collectable != nil || atomic.LoadInt32(&t.marked) != 0
+}
+
+// SetCollectable marks key as collectable, it is collected once nothing refers
+// to it anymore. Marking an object nothing refers to doesn't collect it, RunGC
+// does.
+func (t *threadSafeMap) SetCollectable(key string, collectable bool) error {
+	t.lock.Lock()
+	defer t.unlock()
+
+	if _, exists := t.store.item(key); !exists {
+		return fmt.Errorf("item %s not found", key)
+	}
+	if collectable {
+		atomic.StoreInt32(&t.marked, 1)
+	}
+	relat := t.store.edit(key)
+	relat.collectable = collectable
+	if relat.referenced == nil || relat.referenced.len() == 0 {
+		relat.orphaned = t.options.now().UnixNano()
+	}
+	return nil
+}
+
+// orphaned records key is not referenced anymore, the caller holds the write
+// lock and checks key is stored. It is collected when the lock is released if
+// there is no grace period.
+func (t *threadSafeMap) orphaned(key string, relat *relation) {
+	if !t.gcEnabled() {
+		return
+	}
+	relat.orphaned = t.options.now().UnixNano()
+	t.orphans = append(t.orphans, key)
+}
+
+// orphanedByReplace queues the items left unreferenced by Replace, those
+// already unreferenced before keep their time. The caller holds the write lock.
+func (t *threadSafeMap) orphanedByReplace(items map[string]interface{}) {
+	for key := range items {
+		relat := t.store.relation(key)
+		if relat.referenced != nil && relat.referenced.len() > 0 {
+			continue
+		}
+		if relat.orphaned == 0 {
+			t.orphaned(key, t.store.edit(key))
+		} else {
+			t.orphans = append(t.orphans, key)
+		}
+	}
+}
+
+// isGarbage tells if key is collectable and unreferenced, or without owner,
+// for the grace period. The caller holds the lock of key.
+func (t *threadSafeMap) isGarbage(key string) bool {
+	obj, exists := t.store.item(key)
+	if !exists {
+		return false
+	}
+	relat := t.store.relation(key)
+	if t.isOwnerless(key, nil) {
+		if len(t.strongReferrers(key)) > 0 {
+			return false
+		}
+	} else if relat.referenced != nil && relat.referenced.len() > 0 {
+		return false
+	} else if !relat.collectable && (t.options.collectable == nil || !t.options.collectable(key, obj)) {
+		return false
+	}
+	grace := t.options.gcGracePeriod
+	return grace <= 0 || relat.orphaned+int64(grace) <= t.options.now().UnixNano()
+}
+
+// collect collects the keys orphaned by the last write and, in turn, the keys
+// they were the last to refer to. It returns the collected keys, the caller
+// holds the write lock.
+func (t *threadSafeMap) collect() []string {
+	var collected []string
+	for len(t.orphans) > 0 {
+		key := t.orphans[0]
+		t.orphans = t.orphans[1:]
+		if t.options.gcGracePeriod <= 0 && t.tryCollect(key) {
+			collected = append(collected, key)
+		}
+	}
+	t.orphans = nil
+	return collected
+}
+
+// tryCollect collects key if it is garbage and the finalizers let it be, the
+// caller holds the write lock.
+func (t *threadSafeMap) tryCollect(key string) bool {
+	if !t.isGarbage(key) || !t.finalize(key) {
+		return false
+	}
+	return t.collectItem(key) == nil
+}
+
+// collectItem deletes key and reports it, the caller checks it is garbage. Key
+// stays if the log failed.
+func (t *threadSafeMap) collectItem(key string) error {
+	if err := t.log(walRecord{op: walDelete, key: key}); err != nil {
+		return err
+	}
+	obj, _ := t.store.item(key)
+	t.removeItem(key)
+	t.broadcaster.publish(Event{Type: Collected, Key: key, Object: obj})
+	t.notifyReferrers(key, Collected)
+	return nil
+}
+
+// collectItems collects keys in order, it stops if the log fails.
+func (t *threadSafeMap) collectItems(keys []string) error {
+	for _, key := range keys {
+		if err := t.collectItem(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunGC finds the garbage under the read lock, the objects it was the last to
+// refer to are collected after it unless there is a grace period.
+func (t *threadSafeMap) RunGC() []string {
+	if !t.gcEnabled() {
+		return nil
+	}
+	t.lock.RLock()
+	var garbage []string
+	t.store.eachItem(func(key string, _ interface{}) {
+		if t.isGarbage(key) {
+			garbage = append(garbage, key)
+		}
+	})
+	t.lock.RUnlock()
+	if len(garbage) == 0 {
+		return nil
+	}
+	sort.Strings(garbage)
+
+	t.lock.Lock()
+	defer t.unlock()
+
+	var collected []string
+	for _, key := range garbage {
+		if t.tryCollect(key) {
+			collected = append(collected, key)
+		}
+	}
+	return append(collected, t.collect()...)
+}
+
+func (c *cache) SetCollectable(obj interface{}, collectable bool) error {
+	key, err := c.keyFunc(obj)
+	if err != nil {
+		return types.KeyError{Obj: obj, Err: err}
+	}
+	return c.cacheStorage.SetCollectable(key, collectable)
+}
+
+func (c *cache) RunGC() []string {
+	return c.cacheStorage.RunGC()
+}
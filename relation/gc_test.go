@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GC", func() {
+	BeforeEach(func() {
+		fakeNow = time.Unix(1600000000, 0)
+	})
+
+	forEachEngine(func(name string, opts []Option) {
+		opts = append(opts, fakeClock)
+
+		It("Collect objects of a "+name+" once unreferenced", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c := NewCache(ObjectKey, ObjectRefers, opts...)
+			Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(newObject("d", "c"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(newObject("b", "c"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(newObject("c"))).ShouldNot(HaveOccurred())
+			Expect(c.SetCollectable(newObject("b"), true)).ShouldNot(HaveOccurred())
+			Expect(c.SetCollectable(newObject("c"), true)).ShouldNot(HaveOccurred())
+			events, err := c.Watch(ctx, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(c.Delete(newObject("a"))).ShouldNot(HaveOccurred())
+			Expect((<-events).Type).Should(Equal(Deleted))
+			event := <-events
+			Expect(event.Type).Should(Equal(Collected))
+			Expect(event.Key).Should(Equal("b"))
+			Expect(event.Object).Should(Equal(newObject("b", "c")))
+			// c is still referred to by d
+			Expect(c.ListKeys()).Should(ConsistOf("c", "d"))
+
+			Expect(c.Update(newObject("d"))).ShouldNot(HaveOccurred())
+			Expect((<-events).Type).Should(Equal(Updated))
+			event = <-events
+			Expect(event.Type).Should(Equal(Collected))
+			Expect(event.Key).Should(Equal("c"))
+			Expect(c.ListKeys()).Should(Equal([]string{"d"}))
+			Expect(c.DanglingKeys()).Should(BeEmpty())
+		})
+
+		It("Collect objects of a "+name+" after the grace period", func() {
+			c := NewCache(ObjectKey, ObjectRefers, append(opts, WithGCGracePeriod(time.Minute))...)
+			Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(newObject("b", "c"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(newObject("c"))).ShouldNot(HaveOccurred())
+			Expect(c.SetCollectable(newObject("b"), true)).ShouldNot(HaveOccurred())
+			Expect(c.SetCollectable(newObject("c"), true)).ShouldNot(HaveOccurred())
+
+			Expect(c.Delete(newObject("a"))).ShouldNot(HaveOccurred())
+			Expect(c.ListKeys()).Should(ConsistOf("b", "c"))
+			fakeNow = fakeNow.Add(30 * time.Second)
+			Expect(c.RunGC()).Should(BeEmpty())
+
+			fakeNow = fakeNow.Add(30 * time.Second)
+			Expect(c.RunGC()).Should(Equal([]string{"b"}))
+			// c was left unreferenced by b just now
+			Expect(c.RunGC()).Should(BeEmpty())
+			fakeNow = fakeNow.Add(time.Minute)
+			Expect(c.RunGC()).Should(Equal([]string{"c"}))
+			Expect(c.ListKeys()).Should(BeEmpty())
+		})
+	})
+
+	It("Collect marked objects never referenced by RunGC only", func() {
+		c := NewCache(ObjectKey, ObjectRefers)
+		Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("c"))).ShouldNot(HaveOccurred())
+		Expect(c.SetCollectable(newObject("c"), true)).ShouldNot(HaveOccurred())
+		Expect(c.SetCollectable(newObject("b"), true)).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(ConsistOf("a", "b", "c"))
+
+		Expect(c.RunGC()).Should(Equal([]string{"c"}))
+		Expect(c.ListKeys()).Should(ConsistOf("a", "b"))
+		Expect(c.SetCollectable(newObject("x"), true)).Should(HaveOccurred())
+	})
+
+	It("Collect the objects picked by WithCollectable", func() {
+		sub := func(key string, _ interface{}) bool {
+			return strings.HasPrefix(key, "sub-")
+		}
+		c := NewCache(ObjectKey, ObjectRefers, WithCollectable(sub))
+		Expect(c.Add(newObject("a", "sub-a"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("sub-a", "sub-b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("sub-b", "b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+
+		Expect(c.Delete(newObject("a"))).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(Equal([]string{"b"}))
+	})
+
+	It("Keep unmarked and deleted objects", func() {
+		c := NewCache(ObjectKey, ObjectRefers)
+		Expect(c.Add(newObject("a", "b", "c"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("c"))).ShouldNot(HaveOccurred())
+		Expect(c.SetCollectable(newObject("b"), true)).ShouldNot(HaveOccurred())
+		Expect(c.SetCollectable(newObject("c"), true)).ShouldNot(HaveOccurred())
+		Expect(c.SetCollectable(newObject("b"), false)).ShouldNot(HaveOccurred())
+		// deleting c unmarks it
+		Expect(c.Delete(newObject("c"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("c"))).ShouldNot(HaveOccurred())
+
+		Expect(c.Delete(newObject("a"))).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(ConsistOf("b", "c"))
+		Expect(c.RunGC()).Should(BeEmpty())
+	})
+
+	It("Keep objects marked across transactions and Replace", func() {
+		c := NewCache(ObjectKey, ObjectRefers, WithStrongReferences())
+		Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+		Expect(c.SetCollectable(newObject("b"), true)).ShouldNot(HaveOccurred())
+
+		// the failed transaction restores b marked
+		txn := c.Begin()
+		Expect(txn.Delete(newObject("b"))).ShouldNot(HaveOccurred())
+		Expect(txn.Commit()).Should(HaveOccurred())
+		Expect(c.Replace([]interface{}{newObject("a", "b"), newObject("b")})).ShouldNot(HaveOccurred())
+
+		Expect(c.Replace([]interface{}{newObject("a"), newObject("b")})).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(Equal([]string{"a"}))
+	})
+
+	It("Leave snapshots unchanged", func() {
+		c := NewCache(ObjectKey, ObjectRefers)
+		Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+		Expect(c.SetCollectable(newObject("b"), true)).ShouldNot(HaveOccurred())
+		snapshot := c.Snapshot()
+		defer snapshot.Release()
+
+		Expect(snapshot.SetCollectable(newObject("a"), true)).Should(Equal(ErrReadOnly))
+		Expect(c.Delete(newObject("a"))).ShouldNot(HaveOccurred())
+		Expect(snapshot.RunGC()).Should(BeEmpty())
+		Expect(snapshot.ListKeys()).Should(ConsistOf("a", "b"))
+		Expect(c.ListKeys()).Should(BeEmpty())
+	})
+})
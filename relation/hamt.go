@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import "math/bits"
+
+// edit marks the nodes created by a writer, which the writer may then modify
+// in place. The nodes of another edit, or of none, are copied before being
+// modified, so whoever holds them keeps seeing them unchanged.
+type edit struct{ _ int }
+
+// pmap is a persistent hash array mapped trie from keys to values, a copy of a
+// pmap is a snapshot of it as long as the copy is modified with another edit.
+type pmap struct {
+	root *hamtNode
+	size int
+}
+
+const hamtBits = 5
+
+type hamtNode struct {
+	edit   *edit
+	bitmap uint32
+	// entries are ordered by hash bits, past the last level they collide and
+	// are searched in turn.
+	entries []hamtEntry
+}
+
+// hamtEntry holds either a key with its value or a child node.
+type hamtEntry struct {
+	key   string
+	value interface{}
+	child *hamtNode
+}
+
+// hashKey hashes key with 32-bit FNV-1a.
+func hashKey(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+func (m pmap) get(key string) (interface{}, bool) {
+	hash := hashKey(key)
+	n := m.root
+	for shift := uint(0); n != nil; shift += hamtBits {
+		if shift >= 32 {
+			for _, ent := range n.entries {
+				if ent.key == key {
+					return ent.value, true
+				}
+			}
+			return nil, false
+		}
+		bit := uint32(1) << ((hash >> shift) & 31)
+		if n.bitmap&bit == 0 {
+			return nil, false
+		}
+		ent := n.entries[bits.OnesCount32(n.bitmap&(bit-1))]
+		if ent.child == nil {
+			if ent.key == key {
+				return ent.value, true
+			}
+			return nil, false
+		}
+		n = ent.child
+	}
+	return nil, false
+}
+
+func (m *pmap) set(e *edit, key string, value interface{}) {
+	if m.root == nil {
+		m.root = &hamtNode{edit: e}
+	}
+	var added bool
+	m.root, added = m.root.set(e, 0, hashKey(key), key, value)
+	if added {
+		m.size++
+	}
+}
+
+func (m *pmap) delete(e *edit, key string) {
+	if m.root == nil {
+		return
+	}
+	var removed bool
+	m.root, removed = m.root.delete(e, 0, hashKey(key), key)
+	if removed {
+		m.size--
+	}
+}
+
+// each calls f for every key in no particular order.
+func (m pmap) each(f func(key string, value interface{})) {
+	if m.root != nil {
+		m.root.each(f)
+	}
+}
+
+// editable gives n if e owns it, else a copy of n owned by e.
+func (n *hamtNode) editable(e *edit) *hamtNode {
+	if e != nil && n.edit == e {
+		return n
+	}
+	return &hamtNode{
+		edit:    e,
+		bitmap:  n.bitmap,
+		entries: append([]hamtEntry(nil), n.entries...),
+	}
+}
+
+// set stores value under key below n and tells if key is new.
+func (n *hamtNode) set(e *edit, shift uint, hash uint32, key string, value interface{}) (*hamtNode, bool) {
+	if shift >= 32 {
+		for i, ent := range n.entries {
+			if ent.key == key {
+				m := n.editable(e)
+				m.entries[i].value = value
+				return m, false
+			}
+		}
+		m := n.editable(e)
+		m.entries = append(m.entries, hamtEntry{key: key, value: value})
+		return m, true
+	}
+	bit := uint32(1) << ((hash >> shift) & 31)
+	i := bits.OnesCount32(n.bitmap & (bit - 1))
+	if n.bitmap&bit == 0 {
+		m := n.editable(e)
+		m.bitmap |= bit
+		m.entries = append(m.entries, hamtEntry{})
+		copy(m.entries[i+1:], m.entries[i:])
+		m.entries[i] = hamtEntry{key: key, value: value}
+		return m, true
+	}
+	ent := n.entries[i]
+	added := false
+	switch {
+	case ent.child != nil:
+		ent.child, added = ent.child.set(e, shift+hamtBits, hash, key, value)
+	case ent.key == key:
+		ent.value = value
+	default:
+		// both keys share the bits of this level, push them a level down
+		child := &hamtNode{edit: e}
+		child, _ = child.set(e, shift+hamtBits, hashKey(ent.key), ent.key, ent.value)
+		child, _ = child.set(e, shift+hamtBits, hash, key, value)
+		ent = hamtEntry{child: child}
+		added = true
+	}
+	m := n.editable(e)
+	m.entries[i] = ent
+	return m, added
+}
+
+// delete removes key below n and tells if it was there.
+func (n *hamtNode) delete(e *edit, shift uint, hash uint32, key string) (*hamtNode, bool) {
+	if shift >= 32 {
+		for i, ent := range n.entries {
+			if ent.key == key {
+				m := n.editable(e)
+				m.removeAt(i)
+				return m, true
+			}
+		}
+		return n, false
+	}
+	bit := uint32(1) << ((hash >> shift) & 31)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	i := bits.OnesCount32(n.bitmap & (bit - 1))
+	ent := n.entries[i]
+	if ent.child == nil {
+		if ent.key != key {
+			return n, false
+		}
+		m := n.editable(e)
+		m.bitmap &^= bit
+		m.removeAt(i)
+		return m, true
+	}
+	child, removed := ent.child.delete(e, shift+hamtBits, hash, key)
+	if !removed {
+		return n, false
+	}
+	m := n.editable(e)
+	switch {
+	case len(child.entries) == 0:
+		m.bitmap &^= bit
+		m.removeAt(i)
+	case len(child.entries) == 1 && child.entries[0].child == nil:
+		// a single key left below moves up a level
+		m.entries[i] = child.entries[0]
+	default:
+		m.entries[i].child = child
+	}
+	return m, true
+}
+
+func (n *hamtNode) removeAt(i int) {
+	last := len(n.entries) - 1
+	copy(n.entries[i:], n.entries[i+1:])
+	n.entries[last] = hamtEntry{}
+	n.entries = n.entries[:last]
+}
+
+func (n *hamtNode) each(f func(key string, value interface{})) {
+	for _, ent := range n.entries {
+		if ent.child != nil {
+			ent.child.each(f)
+		} else {
+			f(ent.key, ent.value)
+		}
+	}
+}
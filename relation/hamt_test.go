@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"math/rand"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Persistent map", func() {
+	contents := func(m pmap) map[string]interface{} {
+		c := make(map[string]interface{})
+		m.each(func(key string, value interface{}) {
+			c[key] = value
+		})
+		return c
+	}
+
+	It("Keep frozen copies unchanged", func() {
+		var (
+			m        pmap
+			expected = make(map[string]interface{})
+			frozen   []pmap
+			states   []map[string]interface{}
+		)
+		e := new(edit)
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 20000; i++ {
+			key := strconv.Itoa(r.Intn(5000))
+			if r.Intn(3) == 0 {
+				m.delete(e, key)
+				delete(expected, key)
+			} else {
+				m.set(e, key, i)
+				expected[key] = i
+			}
+			if i%2000 == 0 {
+				frozen = append(frozen, m)
+				state := make(map[string]interface{}, len(expected))
+				for k, v := range expected {
+					state[k] = v
+				}
+				states = append(states, state)
+				e = new(edit)
+			}
+		}
+		Expect(m.size).Should(Equal(len(expected)))
+		Expect(contents(m)).Should(Equal(expected))
+		for key, value := range expected {
+			got, exists := m.get(key)
+			Expect(exists).Should(BeTrue())
+			Expect(got).Should(Equal(value))
+		}
+		for i, f := range frozen {
+			Expect(f.size).Should(Equal(len(states[i])))
+			Expect(contents(f)).Should(Equal(states[i]))
+		}
+	})
+
+	It("Copy on write without edit", func() {
+		var m pmap
+		m.set(nil, "a", 1)
+		before := m
+		m.set(nil, "a", 2)
+		m.set(nil, "b", 3)
+		m.delete(nil, "a")
+		Expect(contents(before)).Should(Equal(map[string]interface{}{"a": 1}))
+		Expect(contents(m)).Should(Equal(map[string]interface{}{"b": 3}))
+	})
+})
@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/firemiles/go-cache/pkg/types"
+)
+
+// index maps an indexed value to the keys indexed with it.
+type index interface {
+	add(values []string, key string)
+	remove(values []string, key string)
+	// keys gives the keys indexed with value, or nil if there is none, it
+	// must not be modified.
+	keys(value string) keySet
+	// values lists the indexed values in no particular order.
+	values() []string
+}
+
+func (t *threadSafeMap) Index(indexName string, obj interface{}) ([]interface{}, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	indexFunc, exists := t.indexers[indexName]
+	if !exists {
+		return nil, fmt.Errorf("index %s does not exist", indexName)
+	}
+	values, err := indexFunc(obj)
+	if err != nil {
+		return nil, types.IndexError{IndexName: indexName, Obj: obj, Err: err}
+	}
+	keys := make(hashSet)
+	for _, value := range values {
+		if set := t.indices[indexName].keys(value); set != nil {
+			for _, key := range set.keys() {
+				keys.add(key)
+			}
+		}
+	}
+	return t.itemsOf(t.unexpiredKeys(sortedKeys(keys))), nil
+}
+
+func (t *threadSafeMap) IndexKeys(indexName, indexedValue string) ([]string, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	idx, exists := t.indices[indexName]
+	if !exists {
+		return nil, fmt.Errorf("index %s does not exist", indexName)
+	}
+	set := idx.keys(indexedValue)
+	if set == nil {
+		return nil, nil
+	}
+	return t.unexpiredKeys(sortedKeys(set)), nil
+}
+
+func (t *threadSafeMap) ListIndexFuncValues(indexName string) []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	idx, exists := t.indices[indexName]
+	if !exists {
+		return []string{}
+	}
+	values := idx.values()
+	sort.Strings(values)
+	return values
+}
+
+func (t *threadSafeMap) ByIndex(indexName, indexedValue string) ([]interface{}, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	idx, exists := t.indices[indexName]
+	if !exists {
+		return nil, fmt.Errorf("index %s does not exist", indexName)
+	}
+	set := idx.keys(indexedValue)
+	if set == nil {
+		return nil, nil
+	}
+	return t.itemsOf(t.unexpiredKeys(sortedKeys(set))), nil
+}
+
+func (t *threadSafeMap) GetIndexers() types.Indexers {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	indexers := make(types.Indexers, len(t.indexers))
+	for name, indexFunc := range t.indexers {
+		indexers[name] = indexFunc
+	}
+	return indexers
+}
+
+func (t *threadSafeMap) AddIndexers(newIndexers types.Indexers) error {
+	t.lock.Lock()
+	defer t.unlock()
+
+	for name := range newIndexers {
+		if _, exists := t.indexers[name]; exists {
+			return fmt.Errorf("indexer conflict: %s", name)
+		}
+	}
+	// index the stored objects first, so a failing IndexFunc changes nothing
+	values := make(map[string]map[string][]string, t.store.len())
+	var err error
+	t.store.eachItem(func(key string, obj interface{}) {
+		if err != nil {
+			return
+		}
+		values[key], err = indexValues(newIndexers, obj)
+	})
+	if err != nil {
+		return err
+	}
+	for name, indexFunc := range newIndexers {
+		t.indexers[name] = indexFunc
+		t.indices[name] = t.store.newIndex()
+	}
+	for key, v := range values {
+		if len(v) == 0 {
+			continue
+		}
+		relat := t.store.edit(key)
+		// the recorded values may be shared, they are replaced, not modified
+		indexed := make(map[string][]string, len(relat.indexed)+len(v))
+		for name, values := range relat.indexed {
+			indexed[name] = values
+		}
+		for name, values := range v {
+			indexed[name] = values
+			t.indices[name].add(values, key)
+		}
+		relat.indexed = indexed
+	}
+	return nil
+}
+
+// itemsOf returns the objects stored under keys.
+func (t *threadSafeMap) itemsOf(keys []string) []interface{} {
+	list := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		obj, _ := t.store.item(key)
+		list = append(list, obj)
+	}
+	return list
+}
+
+// indexValues computes the values of obj for every indexer.
+func indexValues(indexers types.Indexers, obj interface{}) (map[string][]string, error) {
+	if len(indexers) == 0 {
+		return nil, nil
+	}
+	values := make(map[string][]string, len(indexers))
+	for name, indexFunc := range indexers {
+		indexed, err := indexFunc(obj)
+		if err != nil {
+			return nil, types.IndexError{IndexName: name, Obj: obj, Err: err}
+		}
+		values[name] = indexed
+	}
+	return values, nil
+}
+
+// updateIndices replaces the indexed values recorded for key with values, the
+// relation of key must exist.
+func (t *threadSafeMap) updateIndices(key string, values map[string][]string) {
+	t.deleteFromIndices(key)
+	t.store.edit(key).indexed = values
+	if len(values) == 0 {
+		return
+	}
+	t.indexLock.Lock()
+	defer t.indexLock.Unlock()
+	for name, indexed := range values {
+		t.indices[name].add(indexed, key)
+	}
+}
+
+// deleteFromIndices removes key from the indices it was recorded in.
+func (t *threadSafeMap) deleteFromIndices(key string) {
+	relat := t.store.relation(key)
+	if relat == nil || relat.indexed == nil {
+		return
+	}
+	relat = t.store.edit(key)
+	t.indexLock.Lock()
+	defer t.indexLock.Unlock()
+	for name, indexed := range relat.indexed {
+		t.indices[name].remove(indexed, key)
+	}
+	relat.indexed = nil
+}
+
+// buildIndices makes the indices of indexers from the values recorded for
+// every key, with newIndex.
+func buildIndices(newIndex func() index, indexers types.Indexers, values map[string]map[string][]string) map[string]index {
+	indices := make(map[string]index, len(indexers))
+	for name := range indexers {
+		indices[name] = newIndex()
+	}
+	for key, v := range values {
+		for name, indexed := range v {
+			indices[name].add(indexed, key)
+		}
+	}
+	return indices
+}
+
+// hashIndex is the index of the stores modifying their indices in place.
+type hashIndex map[string]keySet
+
+func (idx hashIndex) add(values []string, key string) {
+	for _, value := range values {
+		set, exists := idx[value]
+		if !exists {
+			set = make(hashSet)
+			idx[value] = set
+		}
+		set.add(key)
+	}
+}
+
+func (idx hashIndex) remove(values []string, key string) {
+	for _, value := range values {
+		set, exists := idx[value]
+		if !exists {
+			continue
+		}
+		set.remove(key)
+		if set.len() == 0 {
+			delete(idx, value)
+		}
+	}
+}
+
+func (idx hashIndex) keys(value string) keySet {
+	return idx[value]
+}
+
+func (idx hashIndex) values() []string {
+	values := make([]string, 0, len(idx))
+	for value := range idx {
+		values = append(values, value)
+	}
+	return values
+}
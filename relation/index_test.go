@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/firemiles/go-cache/pkg/types"
+)
+
+func PodOwnerIndex(obj interface{}) ([]string, error) {
+	p := obj.(*Pod)
+	if p.Owner == "" {
+		return nil, nil
+	}
+	return []string{p.Owner}, nil
+}
+
+func PodVolumeIndex(obj interface{}) ([]string, error) {
+	return obj.(*Pod).Volumes, nil
+}
+
+var _ = Describe("Indexers", func() {
+	var c Cache
+	web := &Pod{Name: "web", Owner: "deploy", Volumes: []string{"data", "logs"}}
+	api := &Pod{Name: "api", Owner: "deploy", Volumes: []string{"data"}}
+	job := &Pod{Name: "job", Volumes: []string{"logs"}}
+
+	BeforeEach(func() {
+		c = NewCache(PodKey, nil, WithTypedReferFunc(PodRefers),
+			WithIndexers(types.Indexers{"owner": PodOwnerIndex}))
+		for _, p := range []*Pod{web, api, job} {
+			Expect(c.Add(p)).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("Query index", func() {
+		keys, err := c.IndexKeys("owner", "deploy")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keys).Should(Equal([]string{"api", "web"}))
+		objs, err := c.ByIndex("owner", "deploy")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(objs).Should(Equal([]interface{}{api, web}))
+		objs, err = c.Index("owner", &Pod{Owner: "deploy"})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(objs).Should(Equal([]interface{}{api, web}))
+		Expect(c.ListIndexFuncValues("owner")).Should(Equal([]string{"deploy"}))
+		_, err = c.ByIndex("missing", "deploy")
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("Maintain index", func() {
+		Expect(c.Update(&Pod{Name: "web", Owner: "stateful"})).ShouldNot(HaveOccurred())
+		Expect(c.Delete(api)).ShouldNot(HaveOccurred())
+		Expect(c.ListIndexFuncValues("owner")).Should(Equal([]string{"stateful"}))
+		keys, err := c.IndexKeys("owner", "deploy")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keys).Should(BeEmpty())
+
+		Expect(c.Replace([]interface{}{api, job})).ShouldNot(HaveOccurred())
+		keys, err = c.IndexKeys("owner", "deploy")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keys).Should(Equal([]string{"api"}))
+
+		_, err = c.DeleteCascade(api, DeletePropagationForeground)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(c.ListIndexFuncValues("owner")).Should(BeEmpty())
+	})
+
+	It("Add indexers", func() {
+		Expect(c.AddIndexers(types.Indexers{"owner": PodOwnerIndex})).Should(HaveOccurred())
+		Expect(c.AddIndexers(types.Indexers{"volume": PodVolumeIndex})).ShouldNot(HaveOccurred())
+		Expect(c.GetIndexers()).Should(HaveLen(2))
+		keys, err := c.IndexKeys("volume", "logs")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keys).Should(Equal([]string{"job", "web"}))
+		Expect(c.ListIndexFuncValues("volume")).Should(Equal([]string{"data", "logs"}))
+	})
+
+	It("Reject object failing to index", func() {
+		errBad := errors.New("bad")
+		Expect(c.AddIndexers(types.Indexers{"bad": func(obj interface{}) ([]string, error) {
+			if obj.(*Pod).Name == "bad" {
+				return nil, errBad
+			}
+			return nil, nil
+		}})).ShouldNot(HaveOccurred())
+		err := c.Add(&Pod{Name: "bad", Owner: "deploy"})
+		Expect(err).Should(Equal(types.IndexError{IndexName: "bad", Obj: &Pod{Name: "bad", Owner: "deploy"}, Err: errBad}))
+		_, exists, _ := c.GetByKey("bad")
+		Expect(exists).Should(BeFalse())
+		keys, err := c.IndexKeys("owner", "deploy")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keys).Should(Equal([]string{"api", "web"}))
+	})
+})
@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import "sort"
+
+// keySet is a set of keys, it keeps the refers and the referrers of a relation.
+type keySet interface {
+	// add adds key and tells if it wasn't in the set yet.
+	add(key string) bool
+	remove(key string)
+	contains(key string) bool
+	len() int
+	// keys lists the keys in no particular order.
+	keys() []string
+	// fork copies the set for a writer of edit e.
+	fork(e *edit) keySet
+}
+
+// sortedKeys lists the keys of a relation set in order.
+func sortedKeys(set keySet) []string {
+	keys := set.keys()
+	sort.Strings(keys)
+	return keys
+}
+
+// hashSet is the keySet of the stores modifying relations in place.
+type hashSet map[string]struct{}
+
+func (s hashSet) add(key string) bool {
+	if _, exists := s[key]; exists {
+		return false
+	}
+	s[key] = struct{}{}
+	return true
+}
+
+func (s hashSet) remove(key string) {
+	delete(s, key)
+}
+
+func (s hashSet) contains(key string) bool {
+	_, exists := s[key]
+	return exists
+}
+
+func (s hashSet) len() int {
+	return len(s)
+}
+
+func (s hashSet) keys() []string {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (s hashSet) fork(*edit) keySet {
+	c := make(hashSet, len(s))
+	for key := range s {
+		c[key] = struct{}{}
+	}
+	return c
+}
+
+// persistentSet is the keySet of the copy-on-write store, a fork shares the
+// nodes of the set it was forked from until either is modified.
+type persistentSet struct {
+	m    pmap
+	edit *edit
+}
+
+func (s *persistentSet) add(key string) bool {
+	size := s.m.size
+	s.m.set(s.edit, key, nil)
+	return s.m.size > size
+}
+
+func (s *persistentSet) remove(key string) {
+	s.m.delete(s.edit, key)
+}
+
+func (s *persistentSet) contains(key string) bool {
+	_, exists := s.m.get(key)
+	return exists
+}
+
+func (s *persistentSet) len() int {
+	return s.m.size
+}
+
+func (s *persistentSet) keys() []string {
+	keys := make([]string, 0, s.m.size)
+	s.m.each(func(key string, _ interface{}) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+func (s *persistentSet) fork(e *edit) keySet {
+	return &persistentSet{m: s.m, edit: e}
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"fmt"
+	"sort"
+
+	mapset "github.com/deckarep/golang-set"
+)
+
+// DefaultReferKind is the kind of the refers given by a ReferFunc.
+const DefaultReferKind = ""
+
+// Refer is a reference to the object stored under Key, Kind tells what the
+// reference stands for, e.g. "owner" or "volume".
+type Refer struct {
+	Key  string
+	Kind string
+}
+
+// TypedReferFunc knows how to get kinded refers from an object. Implementations
+// should be deterministic. An object may refer to the same key with several
+// kinds.
+type TypedReferFunc func(obj interface{}) ([]Refer, error)
+
+// typed adapts f to give refers of the DefaultReferKind.
+func (f ReferFunc) typed() TypedReferFunc {
+	return func(obj interface{}) ([]Refer, error) {
+		keys, err := f(obj)
+		if err != nil {
+			return nil, err
+		}
+		refers := make([]Refer, 0, len(keys))
+		for _, key := range keys {
+			refers = append(refers, Refer{Key: key, Kind: DefaultReferKind})
+		}
+		return refers, nil
+	}
+}
+
+// addRefer records refer and tells if refer.Key wasn't referred to yet, the
+// refers of r must be set.
+func (r *relation) addRefer(refer Refer) bool {
+	if r.refers.add(refer.Key) {
+		if refer.Kind != DefaultReferKind {
+			r.setReferKinds(refer.Key, mapset.NewThreadUnsafeSetFromSlice([]interface{}{refer.Kind}))
+		}
+		return true
+	}
+	kinds, exist := r.referKinds[refer.Key]
+	if !exist {
+		if refer.Kind == DefaultReferKind {
+			return false
+		}
+		kinds = mapset.NewThreadUnsafeSetFromSlice([]interface{}{DefaultReferKind})
+		r.setReferKinds(refer.Key, kinds)
+	}
+	kinds.Add(refer.Kind)
+	return false
+}
+
+func (r *relation) setReferKinds(refKey string, kinds mapset.Set) {
+	if r.referKinds == nil {
+		r.referKinds = make(map[string]mapset.Set)
+	}
+	r.referKinds[refKey] = kinds
+}
+
+// refersWithKind tells if r refers to refKey with kind.
+func (r *relation) refersWithKind(refKey string, kind string) bool {
+	if r.refers == nil || !r.refers.contains(refKey) {
+		return false
+	}
+	kinds, exist := r.referKinds[refKey]
+	if !exist {
+		return kind == DefaultReferKind
+	}
+	return kinds.Contains(kind)
+}
+
+// referList lists the refers of r sorted by key and kind.
+func (r *relation) referList() []Refer {
+	if r.refers == nil {
+		return nil
+	}
+	var list []Refer
+	for _, refKey := range sortedKeys(r.refers) {
+		for _, kind := range r.kinds(refKey) {
+			list = append(list, Refer{Key: refKey, Kind: kind})
+		}
+	}
+	return list
+}
+
+// kinds lists in order the kinds r refers to refKey with.
+func (r *relation) kinds(refKey string) []string {
+	kinds, exist := r.referKinds[refKey]
+	if !exist {
+		return []string{DefaultReferKind}
+	}
+	return sortedSet(kinds)
+}
+
+func (t *threadSafeMap) Refers(key string) ([]Refer, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.refersOf(key)
+}
+
+func (t *threadSafeMap) refersOf(key string) ([]Refer, error) {
+	relation := t.store.relation(key)
+	if relation == nil {
+		return nil, fmt.Errorf("relation of key %s not found", key)
+	}
+	return relation.referList(), nil
+}
+
+func (t *threadSafeMap) ReferKeysOfKind(key string, kind string) ([]string, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	relation := t.store.relation(key)
+	if relation == nil {
+		return nil, fmt.Errorf("relation of key %s not found", key)
+	}
+	if relation.refers == nil {
+		return nil, nil
+	}
+	var list []string
+	for _, refKey := range relation.refers.keys() {
+		if relation.refersWithKind(refKey, kind) {
+			list = append(list, refKey)
+		}
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+func (t *threadSafeMap) ReferencedKeysOfKind(key string, kind string) ([]string, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.referencedKeysOfKind(key, kind)
+}
+
+func (t *threadSafeMap) ReferencedOfKind(key string, kind string) ([]interface{}, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	keys, err := t.referencedKeysOfKind(key, kind)
+	if err != nil {
+		return nil, err
+	}
+	var list []interface{}
+	for _, referrer := range keys {
+		obj, exists := t.store.item(referrer)
+		if !exists {
+			return nil, fmt.Errorf("item %s not found", referrer)
+		}
+		list = append(list, obj)
+	}
+	return list, nil
+}
+
+// referencedKeysOfKind lists in order the keys referring to key with kind.
+func (t *threadSafeMap) referencedKeysOfKind(key string, kind string) ([]string, error) {
+	relation := t.store.relation(key)
+	if relation == nil {
+		return nil, fmt.Errorf("relation of key %s not found", key)
+	}
+	if relation.referenced == nil {
+		return nil, nil
+	}
+	var list []string
+	for _, referrer := range relation.referenced.keys() {
+		if t.store.relation(referrer).refersWithKind(key, kind) {
+			list = append(list, referrer)
+		}
+	}
+	sort.Strings(list)
+	return list, nil
+}
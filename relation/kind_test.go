@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type Pod struct {
+	Name    string
+	Owner   string
+	Volumes []string
+	Network string
+}
+
+func PodKey(obj interface{}) (string, error) {
+	return obj.(*Pod).Name, nil
+}
+
+func PodRefers(obj interface{}) ([]Refer, error) {
+	p := obj.(*Pod)
+	var refers []Refer
+	if p.Owner != "" {
+		refers = append(refers, Refer{Key: p.Owner, Kind: "owner"})
+	}
+	for _, v := range p.Volumes {
+		refers = append(refers, Refer{Key: v, Kind: "volume"})
+	}
+	if p.Network != "" {
+		refers = append(refers, Refer{Key: p.Network, Kind: "network"})
+	}
+	return refers, nil
+}
+
+var _ = Describe("Refer kinds", func() {
+	var c Cache
+	web := &Pod{Name: "web", Owner: "deploy", Volumes: []string{"data", "logs"}, Network: "data"}
+	job := &Pod{Name: "job", Volumes: []string{"data"}}
+	deploy := &Pod{Name: "deploy"}
+	data := &Pod{Name: "data"}
+
+	BeforeEach(func() {
+		c = NewCache(PodKey, nil, WithTypedReferFunc(PodRefers), WithStrongReferKinds("owner"))
+		for _, p := range []*Pod{web, job, deploy, data} {
+			Expect(c.Add(p)).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("List refers with kinds", func() {
+		refers, err := c.Refers(web.Name)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(refers).Should(Equal([]Refer{
+			{Key: "data", Kind: "network"},
+			{Key: "data", Kind: "volume"},
+			{Key: "deploy", Kind: "owner"},
+			{Key: "logs", Kind: "volume"},
+		}))
+		keys, err := c.ReferKeys(web.Name)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keys).Should(ConsistOf("data", "deploy", "logs"))
+	})
+
+	It("Filter by kind", func() {
+		keys, err := c.ReferKeysOfKind(web.Name, "volume")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keys).Should(Equal([]string{"data", "logs"}))
+		keys, err = c.ReferencedKeysOfKind(data.Name, "volume")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keys).Should(Equal([]string{"job", "web"}))
+		keys, err = c.ReferencedKeysOfKind(data.Name, "network")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keys).Should(Equal([]string{"web"}))
+		objs, err := c.ReferencedOfKind(deploy, "owner")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(objs).Should(Equal([]interface{}{web}))
+
+		Expect(c.Update(&Pod{Name: "web", Volumes: []string{"data"}})).ShouldNot(HaveOccurred())
+		keys, err = c.ReferencedKeysOfKind(data.Name, "network")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keys).Should(BeEmpty())
+	})
+
+	It("Strong kinds", func() {
+		Expect(c.Delete(deploy)).Should(Equal(ReferencedError{Key: deploy.Name, Referrers: []string{web.Name}}))
+		Expect(c.Delete(data)).ShouldNot(HaveOccurred())
+	})
+
+	It("Default kind", func() {
+		c := NewCache(ObjectKey, ObjectRefers)
+		sub := &Object{ID: "sub"}
+		Expect(c.Add(&Object{ID: "obj", SubObjects: []*Object{sub}})).ShouldNot(HaveOccurred())
+		keys, err := c.ReferencedKeysOfKind(sub.ID, DefaultReferKind)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keys).Should(Equal([]string{"obj"}))
+		refers, err := c.Refers("obj")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(refers).Should(Equal([]Refer{{Key: sub.ID, Kind: DefaultReferKind}}))
+	})
+})
@@ -0,0 +1,327 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"time"
+
+	"github.com/firemiles/go-cache/pkg/types"
+)
+
+// Option configures the behaviour of a Cache and the RelationStore behind it.
+type Option func(*options)
+
+type options struct {
+	// unresolvedRefers keeps objects whose refers can't be calculated.
+	unresolvedRefers bool
+	// strong tells if the reference from referrer to referent is strong.
+	strong func(referrer, referent string) bool
+	// strongKinds are the kinds of references which are strong.
+	strongKinds map[string]bool
+	// danglingResolved is called when a dangling key gets stored.
+	danglingResolved func(key string, referrers []string)
+	// referentChanged is called for every referrer of a changed object.
+	referentChanged func(change ReferentChange)
+	// rejectCycles rejects objects whose refers would make a cycle.
+	rejectCycles bool
+	// typedReferFunc replaces the ReferFunc given to the constructor.
+	typedReferFunc TypedReferFunc
+	// indexers are registered when the store is created.
+	indexers types.Indexers
+	// watchHistory is the number of events kept to resume watching from.
+	watchHistory int
+	// shards is the number of shards of a sharded store.
+	shards int
+	// copyOnWrite makes NewCache use a copy-on-write store.
+	copyOnWrite bool
+	// codec encodes the objects of the snapshots saved by a Cache.
+	codec Codec
+	// syncPolicy decides when the write-ahead log is flushed.
+	syncPolicy SyncPolicy
+	// syncInterval is the period of SyncPeriodically.
+	syncInterval time.Duration
+	// wal records the mutations of the store, see OpenDurableCache.
+	wal *writeAheadLog
+	// defaultTTL is the TTL of the objects stored with DefaultExpiration.
+	defaultTTL time.Duration
+	// janitorInterval is the period of the janitor of a Cache, it has none
+	// if 0.
+	janitorInterval time.Duration
+	// now tells the time objects expire against.
+	now func() time.Time
+	// maxObjects bounds the number of objects, if positive.
+	maxObjects int
+	// maxBytes bounds the total size of the objects as told by sizeOf, if
+	// positive.
+	maxBytes int64
+	sizeOf   func(obj interface{}) int64
+	// evictionPolicy picks the objects to evict, LRU if nil.
+	evictionPolicy EvictionPolicy
+	// protectReferenced never evicts the objects still referred to.
+	protectReferenced bool
+	// collectable tells if an object is collected once unreferenced, on top
+	// of the keys marked by SetCollectable.
+	collectable func(key string, obj interface{}) bool
+	// gcGracePeriod is the time a collectable object is kept unreferenced
+	// before RunGC collects it, it is collected at once if 0.
+	gcGracePeriod time.Duration
+	// ownerGC collects the objects whose owners are all deleted.
+	ownerGC bool
+	// finalizers are run on an object before it is collected.
+	finalizers []func(key string, obj interface{}) error
+}
+
+const (
+	defaultWatchHistory = 100
+	defaultSyncInterval = time.Second
+)
+
+func newOptions(opts []Option) *options {
+	o := &options{watchHistory: defaultWatchHistory, syncInterval: defaultSyncInterval, now: time.Now}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithUnresolvedRefers stores an object even if the ReferFunc fails on it. The
+// object is kept without any refers and marked as unresolved, see
+// Cache.UnresolvedKeys, instead of being rejected with a RefersError.
+func WithUnresolvedRefers() Option {
+	return func(o *options) {
+		o.unresolvedRefers = true
+	}
+}
+
+// WithStrongReferences makes every reference strong: an object can't be deleted
+// as long as another object refers to it, Delete returns a ReferencedError.
+func WithStrongReferences() Option {
+	return WithStrongReferencesFunc(func(referrer, referent string) bool {
+		return true
+	})
+}
+
+// WithStrongReferencesFunc makes the references for which isStrong returns true
+// strong, see WithStrongReferences.
+func WithStrongReferencesFunc(isStrong func(referrer, referent string) bool) Option {
+	return func(o *options) {
+		o.strong = isStrong
+	}
+}
+
+// WithDanglingResolvedFunc registers f to be called whenever a dangling key, a key
+// referred to but not stored, gets stored. f receives the key and its referrers,
+// it is called after the store is unlocked.
+func WithDanglingResolvedFunc(f func(key string, referrers []string)) Option {
+	return func(o *options) {
+		o.danglingResolved = f
+	}
+}
+
+// WithCycleRejection makes Add and Update reject an object whose refers would make
+// a reference cycle with a CycleError. Replace doesn't check for cycles, use
+// Cache.FindCycles after it if needed.
+func WithCycleRejection() Option {
+	return func(o *options) {
+		o.rejectCycles = true
+	}
+}
+
+// WithStrongReferKinds makes the references of the given kinds strong, see
+// WithStrongReferences.
+func WithStrongReferKinds(kinds ...string) Option {
+	return func(o *options) {
+		if o.strongKinds == nil {
+			o.strongKinds = make(map[string]bool, len(kinds))
+		}
+		for _, kind := range kinds {
+			o.strongKinds[kind] = true
+		}
+	}
+}
+
+// WithTypedReferFunc makes the store get kinded refers from f instead of the
+// ReferFunc given to the constructor, which may then be nil.
+func WithTypedReferFunc(f TypedReferFunc) Option {
+	return func(o *options) {
+		o.typedReferFunc = f
+	}
+}
+
+// WithIndexers registers indexers when the store is created, more can be added
+// later with Cache.AddIndexers.
+func WithIndexers(indexers types.Indexers) Option {
+	return func(o *options) {
+		o.indexers = indexers
+	}
+}
+
+// WithWatchHistory sets the number of latest events kept, 100 by default, a
+// watcher can resume from the version of any of them, see WatchFromVersion.
+func WithWatchHistory(size int) Option {
+	return func(o *options) {
+		o.watchHistory = size
+	}
+}
+
+// WithReferentChangedFunc registers f to be called for every object referring to
+// an object which is added, updated or deleted, so the referrers can be
+// reconciled again. f is called after the store is unlocked.
+func WithReferentChangedFunc(f func(change ReferentChange)) Option {
+	return func(o *options) {
+		o.referentChanged = f
+	}
+}
+
+// WithShards spreads the keys over n shards locked separately, so writers of
+// keys in distinct shards don't wait for each other. NewCache uses a sharded
+// store when n is greater than 1, see NewShardedMap.
+func WithShards(n int) Option {
+	return func(o *options) {
+		o.shards = n
+	}
+}
+
+// WithCopyOnWrite makes NewCache use a copy-on-write store, whose reads never
+// wait for writers, see NewCopyOnWriteMap. WithShards is ignored then.
+func WithCopyOnWrite() Option {
+	return func(o *options) {
+		o.copyOnWrite = true
+	}
+}
+
+// WithCodec sets how Cache.SaveSnapshot and Cache.LoadSnapshot encode the
+// objects, the objects are encoded with gob by default, see NewGobCodec.
+func WithCodec(codec Codec) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// WithSyncPolicy sets when a DurableCache flushes its write-ahead log to disk,
+// SyncAlways by default.
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(o *options) {
+		o.syncPolicy = policy
+	}
+}
+
+// WithSyncInterval sets how often SyncPeriodically flushes the write-ahead log,
+// every second by default.
+func WithSyncInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.syncInterval = d
+	}
+}
+
+// WithDefaultTTL expires the objects stored without a TTL of their own once ttl
+// elapses, they never expire by default. See Cache.AddWithTTL.
+func WithDefaultTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.defaultTTL = ttl
+	}
+}
+
+// WithJanitor makes NewCache start a goroutine deleting the expired objects and
+// running Cache.RunGC every interval, until Cache.Stop is called. Without it, an
+// expired object is deleted when it is got, or by Cache.DeleteExpired.
+func WithJanitor(interval time.Duration) Option {
+	return func(o *options) {
+		o.janitorInterval = interval
+	}
+}
+
+// WithMaxObjects bounds the number of objects to n, the objects picked by the
+// eviction policy are evicted beyond it. See WithEvictionPolicy.
+func WithMaxObjects(n int) Option {
+	return func(o *options) {
+		o.maxObjects = n
+	}
+}
+
+// WithMaxBytes bounds the total size of the objects to n bytes, as estimated by
+// sizeOf, the objects picked by the eviction policy are evicted beyond it. A nil
+// sizeOf estimates the memory an object holds by walking it with reflection.
+func WithMaxBytes(n int64, sizeOf func(obj interface{}) int64) Option {
+	return func(o *options) {
+		o.maxBytes = n
+		o.sizeOf = sizeOf
+	}
+}
+
+// WithEvictionPolicy sets the policy picking the objects to evict, LRU by
+// default. A policy serves a single cache. Strongly referenced objects are never
+// evicted, the bounds may be exceeded then.
+func WithEvictionPolicy(policy EvictionPolicy) Option {
+	return func(o *options) {
+		o.evictionPolicy = policy
+	}
+}
+
+// WithReferencedProtected never evicts an object as long as another stored
+// object refers to it, strongly or not.
+func WithReferencedProtected() Option {
+	return func(o *options) {
+		o.protectReferenced = true
+	}
+}
+
+// WithCollectable marks the objects for which collectable returns true as
+// collectable, see Cache.SetCollectable.
+func WithCollectable(collectable func(key string, obj interface{}) bool) Option {
+	return func(o *options) {
+		o.collectable = collectable
+	}
+}
+
+// WithGCGracePeriod keeps a collectable object for d once nothing refers to it
+// anymore, it is collected by Cache.RunGC afterwards. By default it is
+// collected as soon as the last object referring to it is deleted or updated.
+func WithGCGracePeriod(d time.Duration) Option {
+	return func(o *options) {
+		o.gcGracePeriod = d
+	}
+}
+
+// WithOwnerGC collects an object once none of the owners it refers to with
+// OwnerReferKind or BlockingOwnerReferKind is stored, like the collectable
+// objects, see Cache.SetCollectable. Deleting an owner collects first the
+// dependents referring to it with BlockingOwnerReferKind and left without
+// owner, the deletion fails with an OwnerBlockedError if one of them can't be
+// collected and none is collected then. This holds for Delete, Txn.Commit and
+// DeleteCascade, whose propagations other than DeletePropagationOrphan delete
+// the dependents along with their owner instead.
+func WithOwnerGC() Option {
+	return func(o *options) {
+		o.ownerGC = true
+	}
+}
+
+// WithFinalizer runs finalizer on every object about to be collected, the
+// object is kept if it returns an error and collected again by Cache.RunGC. It
+// is called under the write lock and must not use the cache. Finalizers are
+// run in order and again on each attempt, they must be idempotent.
+func WithFinalizer(finalizer func(key string, obj interface{}) error) Option {
+	return func(o *options) {
+		o.finalizers = append(o.finalizers, finalizer)
+	}
+}
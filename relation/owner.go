@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+const (
+	// OwnerReferKind is the kind of the refers to the owners of an object, the
+	// object is collected once none of its owners is stored, see WithOwnerGC.
+	OwnerReferKind = "owner"
+	// BlockingOwnerReferKind is OwnerReferKind also keeping the owner from
+	// being deleted as long as the object can't be collected.
+	BlockingOwnerReferKind = "blocking-owner"
+)
+
+// ownsWithKind tells if r refers to refKey as to an owner.
+func (r *relation) ownsWithKind(refKey string) bool {
+	return r.refersWithKind(refKey, OwnerReferKind) || r.refersWithKind(refKey, BlockingOwnerReferKind)
+}
+
+// isOwnerless tells if key has owners and none of them is stored but those in
+// gone, the caller holds the lock of key.
+func (t *threadSafeMap) isOwnerless(key string, gone map[string]bool) bool {
+	relat := t.store.relation(key)
+	if !t.options.ownerGC || relat.refers == nil {
+		return false
+	}
+	owned := false
+	for _, refKey := range relat.refers.keys() {
+		if !relat.ownsWithKind(refKey) {
+			continue
+		}
+		owned = true
+		if _, stored := t.store.item(refKey); stored && !gone[refKey] {
+			return false
+		}
+	}
+	return owned
+}
+
+// ownerRemoved queues the dependents of key, they are collected once none of
+// their owners is left. The caller holds the write lock.
+func (t *threadSafeMap) ownerRemoved(key string) {
+	relat := t.store.relation(key)
+	if relat == nil || relat.referenced == nil {
+		return
+	}
+	for _, dependent := range sortedKeys(relat.referenced) {
+		if t.store.relation(dependent).ownsWithKind(key) {
+			t.orphaned(dependent, t.store.edit(dependent))
+		}
+	}
+}
+
+// finalize runs the finalizers on key and tells if they all let it be
+// collected, the caller holds the write lock.
+func (t *threadSafeMap) finalize(key string) bool {
+	obj, _ := t.store.item(key)
+	for _, finalizer := range t.options.finalizers {
+		if err := finalizer(key, obj); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// isStronglyReferredOutside tells if an object not in gone strongly refers to
+// key.
+func (t *threadSafeMap) isStronglyReferredOutside(key string, gone map[string]bool) bool {
+	for _, referrer := range t.strongReferrers(key) {
+		if !gone[referrer] {
+			return true
+		}
+	}
+	return false
+}
+
+// unblockOwner collects the dependents blocking the deletion of key, the
+// caller holds the write lock. None is collected unless all of them can be.
+func (t *threadSafeMap) unblockOwner(key string) error {
+	collectable, err := t.blockingOrder([]string{key})
+	if err != nil {
+		return err
+	}
+	return t.collectItems(collectable)
+}
+
+// blockingOrder lists the dependents blocking the deletion of keys in the
+// order to collect them, or returns an OwnerBlockedError if one of them can't
+// be collected. Their finalizers are run, nothing is collected yet.
+func (t *threadSafeMap) blockingOrder(keys []string) ([]string, error) {
+	if !t.options.ownerGC {
+		return nil, nil
+	}
+	gone := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		gone[key] = true
+	}
+	var collectable []string
+	for _, key := range keys {
+		var blocking []string
+		if collectable, blocking = t.blockingDependents(key, gone, collectable); len(blocking) > 0 {
+			return nil, OwnerBlockedError{Key: key, Dependents: blocking}
+		}
+	}
+	return collectable, nil
+}
+
+// blockingDependents appends to collectable the dependents blocking the
+// deletion of key, each one after its own blocking dependents, and returns in
+// order those which can't be collected. gone are the owners being deleted and
+// the dependents in collectable.
+func (t *threadSafeMap) blockingDependents(key string, gone map[string]bool, collectable []string) ([]string, []string) {
+	relat := t.store.relation(key)
+	if relat == nil || relat.referenced == nil {
+		return collectable, nil
+	}
+	var blocking []string
+	for _, dependent := range sortedKeys(relat.referenced) {
+		if gone[dependent] || !t.store.relation(dependent).refersWithKind(key, BlockingOwnerReferKind) {
+			continue
+		}
+		// dependents with an owner left are kept, they don't block
+		if !t.isOwnerless(dependent, gone) {
+			continue
+		}
+		gone[dependent] = true
+		listed := len(collectable)
+		var blocked []string
+		collectable, blocked = t.blockingDependents(dependent, gone, collectable)
+		if len(blocked) > 0 || t.isStronglyReferredOutside(dependent, gone) || !t.finalize(dependent) {
+			// its own dependents stay with it
+			for _, k := range collectable[listed:] {
+				delete(gone, k)
+			}
+			collectable = collectable[:listed]
+			delete(gone, dependent)
+			blocking = append(blocking, dependent)
+			continue
+		}
+		collectable = append(collectable, dependent)
+	}
+	return collectable, blocking
+}
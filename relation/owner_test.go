@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type Owned struct {
+	Name     string
+	Owners   []string
+	Blocking []string
+	Pins     []string
+}
+
+func OwnedKey(obj interface{}) (string, error) {
+	return obj.(*Owned).Name, nil
+}
+
+func OwnedRefers(obj interface{}) ([]Refer, error) {
+	o := obj.(*Owned)
+	var refers []Refer
+	for _, owner := range o.Owners {
+		refers = append(refers, Refer{Key: owner, Kind: OwnerReferKind})
+	}
+	for _, owner := range o.Blocking {
+		refers = append(refers, Refer{Key: owner, Kind: BlockingOwnerReferKind})
+	}
+	for _, pin := range o.Pins {
+		refers = append(refers, Refer{Key: pin, Kind: "pin"})
+	}
+	return refers, nil
+}
+
+var _ = Describe("Owner GC", func() {
+	owned := func(name string, owners ...string) *Owned {
+		return &Owned{Name: name, Owners: owners}
+	}
+	blocking := func(name string, owners ...string) *Owned {
+		return &Owned{Name: name, Blocking: owners}
+	}
+	// finalized fails to finalize the keys of pending.
+	var pending map[string]bool
+	finalized := func(key string, _ interface{}) error {
+		if pending[key] {
+			return errors.New("pending")
+		}
+		return nil
+	}
+	newCache := func(opts ...Option) Cache {
+		opts = append(opts, WithTypedReferFunc(OwnedRefers), WithOwnerGC(), WithFinalizer(finalized))
+		return NewCache(OwnedKey, nil, opts...)
+	}
+	keys := func(events <-chan Event, n int) []string {
+		var list []string
+		for i := 0; i < n; i++ {
+			event := <-events
+			list = append(list, string(event.Type)+" "+event.Key)
+		}
+		return list
+	}
+
+	BeforeEach(func() {
+		fakeNow = time.Unix(1600000000, 0)
+		pending = make(map[string]bool)
+	})
+
+	forEachEngine(func(name string, opts []Option) {
+		opts = append(opts, fakeClock)
+
+		It("Collect the dependents of a "+name+" once their owners are gone", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c := newCache(opts...)
+			Expect(c.Add(owned("deploy"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(owned("rs", "deploy"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(owned("pod-a", "rs"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(owned("pod-b", "rs", "node"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(owned("node"))).ShouldNot(HaveOccurred())
+			events, err := c.Watch(ctx, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(c.Delete(owned("deploy"))).ShouldNot(HaveOccurred())
+			Expect(keys(events, 3)).Should(Equal([]string{"Deleted deploy", "Collected rs", "Collected pod-a"}))
+			// pod-b is still owned by node
+			Expect(c.ListKeys()).Should(ConsistOf("node", "pod-b"))
+
+			Expect(c.Delete(owned("node"))).ShouldNot(HaveOccurred())
+			Expect(keys(events, 2)).Should(Equal([]string{"Deleted node", "Collected pod-b"}))
+			Expect(c.ListKeys()).Should(BeEmpty())
+		})
+
+		It("Block the deletion of owners of a "+name, func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c := newCache(opts...)
+			Expect(c.Add(owned("rs"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(blocking("pod-a", "rs"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(blocking("pod-b", "rs"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(blocking("volume", "pod-b"))).ShouldNot(HaveOccurred())
+			pending["volume"] = true
+			events, err := c.Watch(ctx, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			err = c.Delete(owned("rs"))
+			Expect(err).Should(Equal(OwnerBlockedError{Key: "rs", Dependents: []string{"pod-b"}}))
+			// a blocked deletion collects nothing
+			Expect(events).ShouldNot(Receive())
+			Expect(c.ListKeys()).Should(ConsistOf("rs", "pod-a", "pod-b", "volume"))
+
+			pending["volume"] = false
+			Expect(c.Delete(owned("rs"))).ShouldNot(HaveOccurred())
+			Expect(keys(events, 4)).Should(Equal([]string{"Collected pod-a", "Collected volume", "Collected pod-b", "Deleted rs"}))
+			Expect(c.ListKeys()).Should(BeEmpty())
+		})
+	})
+
+	It("Block the deletion of owners by transactions and orphaning cascades", func() {
+		c := newCache()
+		Expect(c.Add(owned("rs"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(blocking("pod", "rs"))).ShouldNot(HaveOccurred())
+		pending["pod"] = true
+
+		txn := c.Begin()
+		Expect(txn.Delete(owned("rs"))).ShouldNot(HaveOccurred())
+		Expect(txn.Commit()).Should(Equal(OwnerBlockedError{Key: "rs", Dependents: []string{"pod"}}))
+		_, err := c.DeleteCascade(owned("rs"), DeletePropagationOrphan)
+		Expect(err).Should(Equal(OwnerBlockedError{Key: "rs", Dependents: []string{"pod"}}))
+		Expect(c.ListKeys()).Should(ConsistOf("rs", "pod"))
+
+		pending["pod"] = false
+		txn = c.Begin()
+		Expect(txn.Delete(owned("rs"))).ShouldNot(HaveOccurred())
+		Expect(txn.Commit()).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(BeEmpty())
+
+		Expect(c.Add(owned("rs"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(blocking("pod", "rs"))).ShouldNot(HaveOccurred())
+		Expect(c.DeleteCascade(owned("rs"), DeletePropagationOrphan)).Should(Equal([]string{"rs"}))
+		Expect(c.ListKeys()).Should(BeEmpty())
+	})
+
+	It("Keep dependents until they are finalized", func() {
+		c := newCache()
+		Expect(c.Add(owned("rs"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(owned("pod", "rs"))).ShouldNot(HaveOccurred())
+		pending["pod"] = true
+
+		Expect(c.Delete(owned("rs"))).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(Equal([]string{"pod"}))
+		Expect(c.RunGC()).Should(BeEmpty())
+
+		pending["pod"] = false
+		Expect(c.RunGC()).Should(Equal([]string{"pod"}))
+		Expect(c.ListKeys()).Should(BeEmpty())
+	})
+
+	It("Collect dependents after the grace period", func() {
+		c := newCache(fakeClock, WithGCGracePeriod(time.Minute))
+		Expect(c.Add(owned("rs"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(owned("pod", "rs"))).ShouldNot(HaveOccurred())
+		// the owner of orphan was never stored
+		Expect(c.Add(owned("orphan", "gone"))).ShouldNot(HaveOccurred())
+
+		Expect(c.Delete(owned("rs"))).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(ConsistOf("orphan", "pod"))
+		Expect(c.RunGC()).Should(BeEmpty())
+
+		fakeNow = fakeNow.Add(time.Minute)
+		Expect(c.RunGC()).Should(Equal([]string{"orphan", "pod"}))
+	})
+
+	It("Keep dependents strongly referenced", func() {
+		c := newCache(WithStrongReferKinds("pin"))
+		Expect(c.Add(owned("rs"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(owned("pod", "rs"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(&Owned{Name: "holder", Pins: []string{"pod"}})).ShouldNot(HaveOccurred())
+
+		Expect(c.Delete(owned("rs"))).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(ConsistOf("holder", "pod"))
+		Expect(c.RunGC()).Should(BeEmpty())
+
+		Expect(c.Delete(owned("holder"))).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,275 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// snapshotMagic starts every snapshot, snapshotFormat is the version of the
+// layout following it.
+const (
+	snapshotMagic  = "gocache\x00"
+	snapshotFormat = 1
+)
+
+// Codec encodes the objects of a cache for SaveSnapshot and decodes them back
+// for LoadSnapshot.
+type Codec interface {
+	// Name identifies the encoding in the snapshots, a snapshot is loaded with
+	// a codec of the same name only.
+	Name() string
+	// NewEncoder returns an encoder writing objects to w.
+	NewEncoder(w io.Writer) ObjectEncoder
+	// NewDecoder returns a decoder reading the objects written by the encoder
+	// from r.
+	NewDecoder(r io.Reader) ObjectDecoder
+}
+
+// ObjectEncoder writes objects one after the other.
+type ObjectEncoder interface {
+	Encode(obj interface{}) error
+}
+
+// ObjectDecoder reads the objects written by an ObjectEncoder in order.
+type ObjectDecoder interface {
+	Decode() (interface{}, error)
+}
+
+type gobCodec struct{}
+
+// NewGobCodec returns a Codec encoding the objects with encoding/gob as
+// interface values, their types must be registered with gob.Register.
+func NewGobCodec() Codec {
+	return gobCodec{}
+}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) NewEncoder(w io.Writer) ObjectEncoder {
+	return gobEncoder{gob.NewEncoder(w)}
+}
+
+func (gobCodec) NewDecoder(r io.Reader) ObjectDecoder {
+	return gobDecoder{gob.NewDecoder(r)}
+}
+
+type gobEncoder struct {
+	enc *gob.Encoder
+}
+
+func (e gobEncoder) Encode(obj interface{}) error {
+	return e.enc.Encode(&obj)
+}
+
+type gobDecoder struct {
+	dec *gob.Decoder
+}
+
+func (d gobDecoder) Decode() (interface{}, error) {
+	var obj interface{}
+	err := d.dec.Decode(&obj)
+	return obj, err
+}
+
+type jsonCodec struct {
+	newObject func() interface{}
+}
+
+// NewJSONCodec returns a Codec encoding the objects with encoding/json, each
+// object is decoded into the value newObject returns, usually a pointer to a
+// new struct.
+func NewJSONCodec(newObject func() interface{}) Codec {
+	return jsonCodec{newObject: newObject}
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) NewEncoder(w io.Writer) ObjectEncoder {
+	return json.NewEncoder(w)
+}
+
+func (c jsonCodec) NewDecoder(r io.Reader) ObjectDecoder {
+	return jsonDecoder{dec: json.NewDecoder(r), newObject: c.newObject}
+}
+
+type jsonDecoder struct {
+	dec       *json.Decoder
+	newObject func() interface{}
+}
+
+func (d jsonDecoder) Decode() (interface{}, error) {
+	obj := d.newObject()
+	err := d.dec.Decode(obj)
+	return obj, err
+}
+
+// snapshotHeader precedes the encoded objects. A snapshot is laid out as the
+// magic, the header fields in big endian, the codec name prefixed by its
+// length, the encoded objects, then the CRC-32 of everything before it.
+type snapshotHeader struct {
+	format uint16
+	codec  string
+	count  uint64
+	// size is the length of the encoded objects.
+	size uint64
+}
+
+func (h snapshotHeader) write(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString(snapshotMagic)
+	binary.Write(&buf, binary.BigEndian, h.format)
+	buf.WriteByte(byte(len(h.codec)))
+	buf.WriteString(h.codec)
+	binary.Write(&buf, binary.BigEndian, h.count)
+	binary.Write(&buf, binary.BigEndian, h.size)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readSnapshotHeader(r io.Reader) (snapshotHeader, error) {
+	var h snapshotHeader
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return h, snapshotReadError(err)
+	}
+	if string(magic) != snapshotMagic {
+		return h, SnapshotFormatError{Reason: "not a cache snapshot"}
+	}
+	if err := binary.Read(r, binary.BigEndian, &h.format); err != nil {
+		return h, snapshotReadError(err)
+	}
+	if h.format != snapshotFormat {
+		return h, SnapshotFormatError{Reason: fmt.Sprintf("unsupported format version %d", h.format)}
+	}
+	var codecLen uint8
+	if err := binary.Read(r, binary.BigEndian, &codecLen); err != nil {
+		return h, snapshotReadError(err)
+	}
+	codec := make([]byte, codecLen)
+	if _, err := io.ReadFull(r, codec); err != nil {
+		return h, snapshotReadError(err)
+	}
+	h.codec = string(codec)
+	if err := binary.Read(r, binary.BigEndian, &h.count); err != nil {
+		return h, snapshotReadError(err)
+	}
+	if err := binary.Read(r, binary.BigEndian, &h.size); err != nil {
+		return h, snapshotReadError(err)
+	}
+	return h, nil
+}
+
+// snapshotReadError reports a snapshot ending early as a SnapshotFormatError.
+func snapshotReadError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return SnapshotFormatError{Reason: "truncated"}
+	}
+	return err
+}
+
+func (c *cache) SaveSnapshot(w io.Writer) error {
+	if len(c.codec.Name()) > 255 {
+		return fmt.Errorf("codec name %q is too long", c.codec.Name())
+	}
+	snapshot := c.cacheStorage.Snapshot()
+	objs := snapshot.List()
+	snapshot.Release()
+
+	var body bytes.Buffer
+	enc := c.codec.NewEncoder(&body)
+	for _, obj := range objs {
+		if err := enc.Encode(obj); err != nil {
+			return err
+		}
+	}
+
+	sum := crc32.NewIEEE()
+	out := io.MultiWriter(w, sum)
+	header := snapshotHeader{
+		format: snapshotFormat,
+		codec:  c.codec.Name(),
+		count:  uint64(len(objs)),
+		size:   uint64(body.Len()),
+	}
+	if err := header.write(out); err != nil {
+		return err
+	}
+	if _, err := out.Write(body.Bytes()); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, sum.Sum32())
+}
+
+func (c *cache) LoadSnapshot(r io.Reader) error {
+	sum := crc32.NewIEEE()
+	in := io.TeeReader(r, sum)
+	header, err := readSnapshotHeader(in)
+	if err != nil {
+		return err
+	}
+	if header.codec != c.codec.Name() {
+		return SnapshotFormatError{Reason: fmt.Sprintf("encoded with codec %q instead of %q", header.codec, c.codec.Name())}
+	}
+	// every encoded object takes a byte at least
+	if header.count > header.size {
+		return SnapshotFormatError{Reason: fmt.Sprintf("%d objects can't fit in %d bytes", header.count, header.size)}
+	}
+
+	// the objects are decoded once the checksum is verified
+	body, err := io.ReadAll(io.LimitReader(in, int64(header.size)))
+	if err != nil {
+		return err
+	}
+	if uint64(len(body)) < header.size {
+		return SnapshotFormatError{Reason: "truncated"}
+	}
+	var checksum uint32
+	if err := binary.Read(r, binary.BigEndian, &checksum); err != nil {
+		return snapshotReadError(err)
+	}
+	if checksum != sum.Sum32() {
+		return SnapshotFormatError{Reason: "checksum mismatch"}
+	}
+
+	dec := c.codec.NewDecoder(bytes.NewReader(body))
+	objs := make([]interface{}, 0, header.count)
+	for i := uint64(0); i < header.count; i++ {
+		obj, err := dec.Decode()
+		if err != nil {
+			return SnapshotFormatError{Reason: fmt.Sprintf("decoding object %d: %v", i, err)}
+		}
+		objs = append(objs, obj)
+	}
+	return c.Replace(objs)
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Persist snapshot", func() {
+	emptyObject := func() interface{} {
+		return &Object{}
+	}
+	saved := func(opts ...Option) []byte {
+		c := NewCache(ObjectKey, ObjectRefers, opts...)
+		Expect(c.Add(newObject("a", "b", "c"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b", "c"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("d", "a"))).ShouldNot(HaveOccurred())
+		var buf bytes.Buffer
+		Expect(c.SaveSnapshot(&buf)).ShouldNot(HaveOccurred())
+		return buf.Bytes()
+	}
+
+	BeforeEach(func() {
+		gob.Register(&Object{})
+	})
+
+	for name, codec := range map[string]Codec{"gob": NewGobCodec(), "json": NewJSONCodec(emptyObject)} {
+		codec := codec
+
+		It("Restore the objects and relations with "+name, func() {
+			data := saved(WithCodec(codec))
+			c := NewCache(ObjectKey, ObjectRefers, WithCodec(codec))
+			Expect(c.Add(newObject("x", "a"))).ShouldNot(HaveOccurred())
+			Expect(c.LoadSnapshot(bytes.NewReader(data))).ShouldNot(HaveOccurred())
+
+			Expect(c.ListKeys()).Should(ConsistOf("a", "b", "d"))
+			obj, exists, err := c.GetByKey("a")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exists).Should(BeTrue())
+			Expect(obj).Should(Equal(newObject("a", "b", "c")))
+			Expect(c.ReferencedKeys("a")).Should(Equal([]string{"d"}))
+			Expect(c.ReferencedKeys("b")).Should(Equal([]string{"a"}))
+			Expect(c.DanglingKeys()).Should(Equal([]string{"c"}))
+		})
+	}
+
+	It("Save a snapshot of a snapshot", func() {
+		c := NewCache(ObjectKey, ObjectRefers)
+		Expect(c.Add(newObject("a"))).ShouldNot(HaveOccurred())
+		snapshot := c.Snapshot()
+		defer snapshot.Release()
+		Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+
+		var buf bytes.Buffer
+		Expect(snapshot.SaveSnapshot(&buf)).ShouldNot(HaveOccurred())
+		Expect(c.LoadSnapshot(&buf)).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(Equal([]string{"a"}))
+	})
+
+	It("Reject invalid snapshots", func() {
+		data := saved()
+		c := NewCache(ObjectKey, ObjectRefers)
+		Expect(c.Add(newObject("x"))).ShouldNot(HaveOccurred())
+
+		corrupted := append([]byte(nil), data...)
+		corrupted[len(corrupted)-10] ^= 0xff
+		bumped := append([]byte(nil), data...)
+		bumped[len(snapshotMagic)+1]++
+
+		for reason, invalid := range map[string][]byte{
+			"not a cache snapshot":         []byte("not a snapshot at all"),
+			"unsupported format version 2": bumped,
+			"truncated":                    data[:len(data)-2],
+			"checksum mismatch":            corrupted,
+		} {
+			err := c.LoadSnapshot(bytes.NewReader(invalid))
+			Expect(err).Should(Equal(SnapshotFormatError{Reason: reason}))
+		}
+
+		err := NewCache(ObjectKey, ObjectRefers, WithCodec(NewJSONCodec(emptyObject))).LoadSnapshot(bytes.NewReader(data))
+		Expect(err).Should(Equal(SnapshotFormatError{Reason: `encoded with codec "gob" instead of "json"`}))
+		Expect(c.ListKeys()).Should(Equal([]string{"x"}))
+	})
+})
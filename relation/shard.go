@@ -0,0 +1,241 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"sort"
+	"sync"
+)
+
+// shard holds the items and relations of the keys hashed to it, guarded by
+// its own lock.
+type shard struct {
+	lock      sync.RWMutex
+	items     map[string]interface{}
+	relations map[string]*relation
+}
+
+// shards spreads the keys over shards by hash. Locking shards as a whole locks
+// every shard in order, which is the lock of a store with a single shard.
+type shards []*shard
+
+func newShards(n int) shards {
+	return newShardsSized(n, 0)
+}
+
+// newShardsSized makes n shards with room for size keys spread over them.
+func newShardsSized(n, size int) shards {
+	s := make(shards, n)
+	for i := range s {
+		s[i] = &shard{
+			items:     make(map[string]interface{}, size/n),
+			relations: make(map[string]*relation, size/n),
+		}
+	}
+	return s
+}
+
+// index gives the shard key is hashed to.
+func (s shards) index(key string) int {
+	if len(s) == 1 {
+		return 0
+	}
+	return int(hashKey(key) % uint32(len(s)))
+}
+
+func (s shards) of(key string) *shard {
+	return s[s.index(key)]
+}
+
+func (s shards) item(key string) (interface{}, bool) {
+	obj, exists := s.of(key).items[key]
+	return obj, exists
+}
+
+func (s shards) setItem(key string, obj interface{}) {
+	s.of(key).items[key] = obj
+}
+
+func (s shards) deleteItem(key string) {
+	delete(s.of(key).items, key)
+}
+
+func (s shards) relation(key string) *relation {
+	return s.of(key).relations[key]
+}
+
+// edit gives the relation of key, the relations of shards are modified in
+// place.
+func (s shards) edit(key string) *relation {
+	return s.of(key).relations[key]
+}
+
+func (s shards) setRelation(key string, relat *relation) {
+	s.of(key).relations[key] = relat
+}
+
+func (s shards) deleteRelation(key string) {
+	delete(s.of(key).relations, key)
+}
+
+func (s shards) newSet() keySet {
+	return make(hashSet)
+}
+
+func (s shards) newIndex() index {
+	return make(hashIndex)
+}
+
+func (s shards) len() int {
+	n := 0
+	for _, sh := range s {
+		n += len(sh.items)
+	}
+	return n
+}
+
+func (s shards) eachItem(f func(key string, obj interface{})) {
+	for _, sh := range s {
+		for key, obj := range sh.items {
+			f(key, obj)
+		}
+	}
+}
+
+func (s shards) eachRelation(f func(key string, relat *relation)) {
+	for _, sh := range s {
+		for key, relat := range sh.relations {
+			f(key, relat)
+		}
+	}
+}
+
+func (s shards) empty(size int) storage {
+	return newShardsSized(len(s), size)
+}
+
+// replace keeps the locks of s, only the maps are swapped.
+func (s shards) replace(next storage) {
+	for i, sh := range s {
+		sh.items = next.(shards)[i].items
+		sh.relations = next.(shards)[i].relations
+	}
+}
+
+// view shares the maps of s, not its locks.
+func (s shards) view() storage {
+	v := make(shards, len(s))
+	for i, sh := range s {
+		v[i] = &shard{items: sh.items, relations: sh.relations}
+	}
+	return v
+}
+
+// detach copies the maps of every shard, along with the relations which are
+// modified in place.
+func (s shards) detach() {
+	for _, sh := range s {
+		items := make(map[string]interface{}, len(sh.items))
+		for key, obj := range sh.items {
+			items[key] = obj
+		}
+		relations := make(map[string]*relation, len(sh.relations))
+		for key, relat := range sh.relations {
+			relations[key] = relat.fork(nil)
+		}
+		sh.items = items
+		sh.relations = relations
+	}
+}
+
+func (s shards) Lock() {
+	for _, sh := range s {
+		sh.lock.Lock()
+	}
+}
+
+func (s shards) Unlock() {
+	for i := len(s) - 1; i >= 0; i-- {
+		s[i].lock.Unlock()
+	}
+}
+
+func (s shards) RLock() {
+	for _, sh := range s {
+		sh.lock.RLock()
+	}
+}
+
+func (s shards) RUnlock() {
+	for i := len(s) - 1; i >= 0; i-- {
+		s[i].lock.RUnlock()
+	}
+}
+
+// rwLocker is the lock of a whole store.
+type rwLocker interface {
+	sync.Locker
+	RLock()
+	RUnlock()
+}
+
+// shardSet is a sorted set of shard indexes, locked in order so writers
+// locking several shards never deadlock.
+type shardSet []int
+
+// add adds the shards of keys to set.
+func (set shardSet) add(s shards, keys ...string) shardSet {
+	for _, key := range keys {
+		i := s.index(key)
+		at := sort.SearchInts(set, i)
+		if at < len(set) && set[at] == i {
+			continue
+		}
+		set = append(set, 0)
+		copy(set[at+1:], set[at:])
+		set[at] = i
+	}
+	return set
+}
+
+// covers tells if the shards of keys are all in set.
+func (set shardSet) covers(s shards, keys []string) bool {
+	for _, key := range keys {
+		i := s.index(key)
+		if at := sort.SearchInts(set, i); at == len(set) || set[at] != i {
+			return false
+		}
+	}
+	return true
+}
+
+func (set shardSet) lock(s shards) {
+	for _, i := range set {
+		s[i].lock.Lock()
+	}
+}
+
+func (set shardSet) unlock(s shards) {
+	for i := len(set) - 1; i >= 0; i-- {
+		s[set[i]].lock.Unlock()
+	}
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import "time"
+
+const defaultShards = 32
+
+// shardedMap is a threadSafeMap whose keys are spread over shards. Writes of a
+// key lock only the shards of the key and of the keys it is related to, an edge
+// spanning shards is updated with both of them locked. Everything else, like
+// Replace, transactions or the graph queries, locks every shard.
+type shardedMap struct {
+	*threadSafeMap
+	shards shards
+}
+
+var _ RelationStore = &shardedMap{}
+
+// NewShardedMap returns a RelationStore spreading the keys over the shards set
+// by WithShards, 32 by default, for writers to scale over goroutines.
+func NewShardedMap(referFunc ReferFunc, opts ...Option) RelationStore {
+	options := newOptions(opts)
+	n := options.shards
+	if n < 1 {
+		n = defaultShards
+	}
+	shards := newShards(n)
+	return &shardedMap{threadSafeMap: newThreadSafeMap(referFunc, shards, shards, options), shards: shards}
+}
+
+func (s *shardedMap) Add(key string, obj interface{}) error {
+	return s.Update(key, obj)
+}
+
+func (s *shardedMap) Update(key string, obj interface{}) error {
+	return s.UpdateWithTTL(key, obj, DefaultExpiration)
+}
+
+func (s *shardedMap) UpdateWithTTL(key string, obj interface{}, ttl time.Duration) error {
+	refers, unresolved, err := s.refers(key, obj)
+	if err != nil {
+		return err
+	}
+
+	unlock := s.lockWrite(key, refers, false)
+	defer unlock()
+
+	return s.update(key, obj, refers, unresolved, ttl)
+}
+
+func (s *shardedMap) UpdateIfVersion(key string, obj interface{}, expectedVersion uint64) error {
+	refers, unresolved, err := s.refers(key, obj)
+	if err != nil {
+		return err
+	}
+
+	unlock := s.lockWrite(key, refers, false)
+	defer unlock()
+
+	if version := s.version(key); version != expectedVersion {
+		return ConflictError{Key: key, Expected: expectedVersion, Actual: version}
+	}
+	return s.update(key, obj, refers, unresolved, DefaultExpiration)
+}
+
+func (s *shardedMap) Delete(key string) error {
+	// strong kinds are looked up in the relations of the referrers
+	unlock := s.lockWrite(key, nil, len(s.options.strongKinds) > 0)
+	defer unlock()
+
+	if _, exists := s.shards.item(key); exists {
+		if referrers := s.strongReferrers(key); len(referrers) > 0 {
+			return ReferencedError{Key: key, Referrers: referrers}
+		}
+		if err := s.unblockOwner(key); err != nil {
+			return err
+		}
+		if err := s.deleteItem(key); err != nil {
+			return err
+		}
+		s.notifyReferrers(key, Deleted)
+	}
+	return nil
+}
+
+func (s *shardedMap) Get(key string) (item interface{}, exists bool) {
+	item, _, exists = s.GetWithVersion(key)
+	return item, exists
+}
+
+func (s *shardedMap) GetWithVersion(key string) (item interface{}, version uint64, exists bool) {
+	sh := s.shards.of(key)
+	sh.lock.RLock()
+	item, version, exists, expired := s.lookup(key)
+	sh.lock.RUnlock()
+
+	if expired && s.expireKey(key) {
+		return nil, 0, false
+	}
+	if exists {
+		s.accessed(key)
+	}
+	return item, version, exists
+}
+
+func (s *shardedMap) ReferencedKeys(key string) ([]string, error) {
+	sh := s.shards.of(key)
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+
+	return s.referencedKeys(key)
+}
+
+func (s *shardedMap) ReferKeys(key string) ([]string, error) {
+	sh := s.shards.of(key)
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+
+	return s.referKeys(key)
+}
+
+func (s *shardedMap) Refers(key string) ([]Refer, error) {
+	sh := s.shards.of(key)
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+
+	return s.refersOf(key)
+}
+
+// lockWrite write locks the shards touched by a write of key: the shard of key
+// and the ones of refers, of the keys key refers to so far and, if referrers is
+// set, of the keys referring to key. The keys related to key are read before
+// the shards are locked, so locking is retried until they didn't change
+// meanwhile. Finding cycles and evicting read the whole store, every shard is
+// locked then.
+// The returned func unlocks the shards.
+func (s *shardedMap) lockWrite(key string, refers []Refer, referrers bool) func() {
+	if s.options.rejectCycles || s.evictor != nil || s.gcEnabled() {
+		s.lock.Lock()
+		return s.unlock
+	}
+	set := shardSet(nil).add(s.shards, key)
+	for _, refer := range refers {
+		set = set.add(s.shards, refer.Key)
+	}
+	for {
+		sh := s.shards.of(key)
+		sh.lock.RLock()
+		related := s.related(key, referrers)
+		sh.lock.RUnlock()
+
+		set = set.add(s.shards, related...)
+		set.lock(s.shards)
+		if s.isShared() || s.gcEnabled() {
+			// detaching the storage from the snapshots, or collecting the
+			// keys orphaned by the write, takes every shard
+			set.unlock(s.shards)
+			s.lock.Lock()
+			return s.unlock
+		}
+		if set.covers(s.shards, s.related(key, referrers)) {
+			return func() {
+				set.unlock(s.shards)
+				s.runPending()
+			}
+		}
+		set.unlock(s.shards)
+	}
+}
+
+// related lists the keys key refers to and, if referrers is set, the keys
+// referring to it.
+func (s *shardedMap) related(key string, referrers bool) []string {
+	relat := s.shards.relation(key)
+	if relat == nil {
+		return nil
+	}
+	var keys []string
+	if relat.refers != nil {
+		keys = append(keys, relat.refers.keys()...)
+	}
+	if referrers && relat.referenced != nil {
+		keys = append(keys, relat.referenced.keys()...)
+	}
+	return keys
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sharded store", func() {
+	It("Keep relations across shards", func() {
+		c := NewCache(ObjectKey, ObjectRefers, WithShards(8), WithStrongReferences())
+		Expect(c.Add(newObject("a", "b", "c"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b", "c"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("c"))).ShouldNot(HaveOccurred())
+		Expect(c.ReferencedKeys("c")).Should(ConsistOf("a", "b"))
+		Expect(c.Delete(newObject("c"))).Should(Equal(ReferencedError{Key: "c", Referrers: []string{"a", "b"}}))
+
+		Expect(c.Update(newObject("a", "d"))).ShouldNot(HaveOccurred())
+		Expect(c.ReferencedKeys("c")).Should(Equal([]string{"b"}))
+		Expect(c.DanglingKeys()).Should(Equal([]string{"d"}))
+		Expect(c.Delete(newObject("a"))).ShouldNot(HaveOccurred())
+		Expect(c.DanglingKeys()).Should(BeEmpty())
+		Expect(c.TopologicalKeys()).Should(Equal([]string{"c", "b"}))
+	})
+
+	It("Write concurrently", func() {
+		const n = 1000
+		c := NewCache(ObjectKey, ObjectRefers, WithShards(8))
+		var wait sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wait.Add(1)
+			go func(g int) {
+				defer GinkgoRecover()
+				defer wait.Done()
+				for i := g; i < n; i += 4 {
+					next := strconv.Itoa((i + 1) % n)
+					Expect(c.Add(newObject(strconv.Itoa(i), next, "shared"))).ShouldNot(HaveOccurred())
+					if i%3 == 0 {
+						Expect(c.Delete(newObject(strconv.Itoa(i)))).ShouldNot(HaveOccurred())
+					}
+				}
+			}(g)
+		}
+		wait.Wait()
+
+		var stored []string
+		for i := 0; i < n; i++ {
+			if i%3 != 0 {
+				stored = append(stored, strconv.Itoa(i))
+			}
+		}
+		Expect(c.ListKeys()).Should(ConsistOf(stored))
+		referrers, err := c.ReferencedKeys("shared")
+		Expect(err).ShouldNot(HaveOccurred())
+		sort.Strings(referrers)
+		sort.Strings(stored)
+		Expect(referrers).Should(Equal(stored))
+		for i := 0; i < n; i++ {
+			referrers, _ := c.ReferencedKeys(strconv.Itoa(i))
+			prev := (i + n - 1) % n
+			if prev%3 == 0 {
+				Expect(referrers).Should(BeEmpty())
+			} else {
+				Expect(referrers).Should(Equal([]string{strconv.Itoa(prev)}))
+			}
+		}
+		dangling := []string{"shared"}
+		for i := 0; i < n; i += 3 {
+			if (i+n-1)%n%3 != 0 {
+				dangling = append(dangling, strconv.Itoa(i))
+			}
+		}
+		Expect(c.DanglingKeys()).Should(ConsistOf(dangling))
+	})
+})
@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/firemiles/go-cache/pkg/types"
+)
+
+// ErrReadOnly is returned by the writes of a snapshot.
+var ErrReadOnly = errors.New("snapshot is read-only")
+
+// StoreSnapshot is a read-only view of a RelationStore frozen at the time it
+// was taken, its writes return ErrReadOnly.
+type StoreSnapshot interface {
+	RelationStore
+	// Release tells the snapshot is no longer used, it must not be used after.
+	// Releasing snapshots spares the store copying its contents on the next
+	// write.
+	Release()
+}
+
+// sharing counts the snapshots sharing the storage of a store.
+type sharing struct {
+	snapshots int32
+}
+
+// snapshotLock is the lock of a store, the first writer after a snapshot
+// detaches the storage from the snapshots still in use.
+type snapshotLock struct {
+	rwLocker
+	t *threadSafeMap
+}
+
+func (l *snapshotLock) Lock() {
+	l.rwLocker.Lock()
+	l.t.detach()
+}
+
+// isShared tells if snapshots still use the storage, the caller holds a lock.
+func (t *threadSafeMap) isShared() bool {
+	return atomic.LoadInt32(&t.shared.snapshots) > 0
+}
+
+// detach copies the storage if snapshots still use it, the caller holds the
+// write lock.
+func (t *threadSafeMap) detach() {
+	if !t.isShared() {
+		return
+	}
+	t.store.detach()
+	t.shared = new(sharing)
+}
+
+// Snapshot shares the storage with the snapshot, the storage is copied by the
+// next writer unless the snapshot is released first.
+func (t *threadSafeMap) Snapshot() StoreSnapshot {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	atomic.AddInt32(&t.shared.snapshots, 1)
+	return newSnapshotMap(t, t.store.view(), t.broadcaster.currentVersion(), t.shared)
+}
+
+// snapshotMap is a read-only view of a store frozen at a version. Unless they
+// are given, its indices are built from the recorded index values on first
+// use.
+type snapshotMap struct {
+	*threadSafeMap
+	version   uint64
+	indexOnce sync.Once
+	// sharing counts the snapshots sharing the storage with the store, it is
+	// nil if the storage is never modified.
+	sharing  *sharing
+	released int32
+}
+
+var _ StoreSnapshot = &snapshotMap{}
+
+// newSnapshotMap makes a view of t over store, the caller holds the lock of t.
+func newSnapshotMap(t *threadSafeMap, store storage, version uint64, shared *sharing) *snapshotMap {
+	view := &threadSafeMap{
+		store:     store,
+		lock:      frozenLock{},
+		referFunc: t.referFunc,
+		options:   t.options,
+		indexers:  make(types.Indexers, len(t.indexers)),
+		// the objects of a snapshot never expire
+		keepExpired: true,
+	}
+	for name, indexFunc := range t.indexers {
+		view.indexers[name] = indexFunc
+	}
+	return &snapshotMap{threadSafeMap: view, version: version, sharing: shared}
+}
+
+// frozenLock is the lock of a snapshot, nothing writes to it.
+type frozenLock struct{}
+
+func (frozenLock) Lock()    {}
+func (frozenLock) Unlock()  {}
+func (frozenLock) RLock()   {}
+func (frozenLock) RUnlock() {}
+
+// Snapshot returns another view of the storage, released on its own.
+func (s *snapshotMap) Snapshot() StoreSnapshot {
+	if s.sharing != nil {
+		atomic.AddInt32(&s.sharing.snapshots, 1)
+	}
+	return newSnapshotMap(s.threadSafeMap, s.store, s.version, s.sharing)
+}
+
+func (s *snapshotMap) Release() {
+	if s.sharing != nil && atomic.CompareAndSwapInt32(&s.released, 0, 1) {
+		atomic.AddInt32(&s.sharing.snapshots, -1)
+	}
+}
+
+func (s *snapshotMap) Add(string, interface{}) error {
+	return ErrReadOnly
+}
+
+func (s *snapshotMap) Update(string, interface{}) error {
+	return ErrReadOnly
+}
+
+func (s *snapshotMap) UpdateIfVersion(string, interface{}, uint64) error {
+	return ErrReadOnly
+}
+
+func (s *snapshotMap) UpdateWithTTL(string, interface{}, time.Duration) error {
+	return ErrReadOnly
+}
+
+// DeleteExpired deletes nothing, the objects of a snapshot never expire.
+func (s *snapshotMap) DeleteExpired() []string {
+	return nil
+}
+
+func (s *snapshotMap) SetCollectable(string, bool) error {
+	return ErrReadOnly
+}
+
+// RunGC collects nothing, a snapshot is never modified.
+func (s *snapshotMap) RunGC() []string {
+	return nil
+}
+
+func (s *snapshotMap) Delete(string) error {
+	return ErrReadOnly
+}
+
+func (s *snapshotMap) Replace(map[string]interface{}) (ReplaceDelta, error) {
+	return ReplaceDelta{}, ErrReadOnly
+}
+
+func (s *snapshotMap) Commit([]TxnOp) error {
+	return ErrReadOnly
+}
+
+func (s *snapshotMap) DeleteCascade(string, DeletionPropagation) ([]string, error) {
+	return nil, ErrReadOnly
+}
+
+func (s *snapshotMap) AddIndexers(types.Indexers) error {
+	return ErrReadOnly
+}
+
+// Watch fails, nothing happens to a snapshot.
+func (s *snapshotMap) Watch(context.Context, func(Event) bool, ...WatchOption) (<-chan Event, error) {
+	return nil, ErrReadOnly
+}
+
+// Get returns the object as it was when the snapshot was taken, expired or not.
+func (s *snapshotMap) Get(key string) (item interface{}, exists bool) {
+	item, _, exists, _ = s.lookup(key)
+	return item, exists
+}
+
+func (s *snapshotMap) GetWithVersion(key string) (item interface{}, version uint64, exists bool) {
+	item, version, exists, _ = s.lookup(key)
+	return item, version, exists
+}
+
+func (s *snapshotMap) ListWithVersion() ([]interface{}, uint64) {
+	return s.List(), s.version
+}
+
+func (s *snapshotMap) Index(indexName string, obj interface{}) ([]interface{}, error) {
+	s.indexOnce.Do(s.buildIndices)
+	return s.threadSafeMap.Index(indexName, obj)
+}
+
+func (s *snapshotMap) IndexKeys(indexName, indexedValue string) ([]string, error) {
+	s.indexOnce.Do(s.buildIndices)
+	return s.threadSafeMap.IndexKeys(indexName, indexedValue)
+}
+
+func (s *snapshotMap) ListIndexFuncValues(indexName string) []string {
+	s.indexOnce.Do(s.buildIndices)
+	return s.threadSafeMap.ListIndexFuncValues(indexName)
+}
+
+func (s *snapshotMap) ByIndex(indexName, indexedValue string) ([]interface{}, error) {
+	s.indexOnce.Do(s.buildIndices)
+	return s.threadSafeMap.ByIndex(indexName, indexedValue)
+}
+
+// buildIndices indexes the items with the values recorded in their relations.
+func (s *snapshotMap) buildIndices() {
+	if s.indices != nil {
+		return
+	}
+	values := make(map[string]map[string][]string)
+	s.store.eachItem(func(key string, _ interface{}) {
+		if indexed := s.store.relation(key).indexed; indexed != nil {
+			values[key] = indexed
+		}
+	})
+	s.indices = buildIndices(s.store.newIndex, s.indexers, values)
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/firemiles/go-cache/pkg/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Snapshot", func() {
+	prefixIndex := func(obj interface{}) ([]string, error) {
+		return []string{strings.SplitN(obj.(*Object).ID, "-", 2)[0]}, nil
+	}
+
+	forEachEngine(func(name string, opts []Option) {
+		opts = append(opts, WithIndexers(types.Indexers{"prefix": prefixIndex}))
+
+		It("Keep the view of a "+name+" unchanged", func() {
+			c := NewCache(ObjectKey, ObjectRefers, opts...)
+			Expect(c.Add(newObject("a-1", "b-1"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(newObject("b-1"))).ShouldNot(HaveOccurred())
+			snapshot := c.Snapshot()
+			defer snapshot.Release()
+
+			Expect(c.Update(newObject("a-1", "b-2"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(newObject("a-2", "b-1"))).ShouldNot(HaveOccurred())
+			Expect(c.Delete(newObject("b-1"))).ShouldNot(HaveOccurred())
+
+			Expect(snapshot.ListKeys()).Should(ConsistOf("a-1", "b-1"))
+			Expect(snapshot.ReferencedKeys("b-1")).Should(Equal([]string{"a-1"}))
+			Expect(snapshot.ReferKeys("a-1")).Should(Equal([]string{"b-1"}))
+			Expect(snapshot.DanglingKeys()).Should(BeEmpty())
+			Expect(snapshot.IndexKeys("prefix", "a")).Should(Equal([]string{"a-1"}))
+			_, version, exists, err := snapshot.GetByKeyWithVersion("a-1")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exists).Should(BeTrue())
+			Expect(version).Should(Equal(uint64(1)))
+
+			Expect(c.ReferencedKeys("b-1")).Should(Equal([]string{"a-2"}))
+			Expect(c.DanglingKeys()).Should(Equal([]string{"b-1", "b-2"}))
+			Expect(c.IndexKeys("prefix", "a")).Should(Equal([]string{"a-1", "a-2"}))
+		})
+
+		It("Reject writes through a snapshot of a "+name, func() {
+			c := NewCache(ObjectKey, ObjectRefers, opts...)
+			Expect(c.Add(newObject("a"))).ShouldNot(HaveOccurred())
+			snapshot := c.Snapshot()
+			defer snapshot.Release()
+
+			Expect(snapshot.Add(newObject("b"))).Should(Equal(ErrReadOnly))
+			Expect(snapshot.Update(newObject("a", "b"))).Should(Equal(ErrReadOnly))
+			Expect(snapshot.UpdateIfVersion(newObject("a", "b"), 1)).Should(Equal(ErrReadOnly))
+			Expect(snapshot.Delete(newObject("a"))).Should(Equal(ErrReadOnly))
+			Expect(snapshot.Replace(nil)).Should(Equal(ErrReadOnly))
+			_, err := snapshot.DeleteCascade(newObject("a"), DeletePropagationOrphan)
+			Expect(err).Should(Equal(ErrReadOnly))
+			Expect(snapshot.AddIndexers(types.Indexers{"id": prefixIndex})).Should(Equal(ErrReadOnly))
+			_, err = snapshot.Watch(context.Background(), nil)
+			Expect(err).Should(Equal(ErrReadOnly))
+			txn := snapshot.Begin()
+			Expect(txn.Add(newObject("b"))).ShouldNot(HaveOccurred())
+			Expect(txn.Commit()).Should(Equal(ErrReadOnly))
+
+			Expect(c.ListKeys()).Should(Equal([]string{"a"}))
+			Expect(snapshot.ListKeys()).Should(Equal([]string{"a"}))
+		})
+	})
+
+	It("Copy the storage only for the snapshots in use", func() {
+		store := NewThreadSafeMap(ObjectRefers).(*threadSafeMap)
+		Expect(store.Add("a", newObject("a", "b"))).ShouldNot(HaveOccurred())
+		shared := store.shared
+
+		store.Snapshot().Release()
+		Expect(store.Add("b", newObject("b"))).ShouldNot(HaveOccurred())
+		Expect(store.shared).Should(BeIdenticalTo(shared))
+
+		snapshot := store.Snapshot()
+		nested := snapshot.Snapshot()
+		snapshot.Release()
+		snapshot.Release()
+		Expect(store.Add("c", newObject("c", "b"))).ShouldNot(HaveOccurred())
+		Expect(store.shared).ShouldNot(BeIdenticalTo(shared))
+		Expect(nested.ReferencedKeys("b")).Should(Equal([]string{"a"}))
+		Expect(store.ReferencedKeys("b")).Should(ConsistOf("a", "c"))
+		nested.Release()
+	})
+
+	It("Take snapshots while writing", func() {
+		store := NewShardedMap(ObjectRefers, WithShards(4))
+		Expect(store.Add("root", newObject("root"))).ShouldNot(HaveOccurred())
+		done := make(chan struct{})
+		var wait sync.WaitGroup
+		for g := 0; g < 2; g++ {
+			wait.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wait.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					snapshot := store.Snapshot()
+					referrers, err := snapshot.ReferencedKeys("root")
+					Expect(err).ShouldNot(HaveOccurred())
+					for _, referrer := range referrers {
+						refers, err := snapshot.ReferKeys(referrer)
+						Expect(err).ShouldNot(HaveOccurred())
+						Expect(refers).Should(Equal([]string{"root"}))
+					}
+					snapshot.Release()
+				}
+			}()
+		}
+		for i := 0; i < 500; i++ {
+			key := strconv.Itoa(i)
+			Expect(store.Add(key, newObject(key, "root"))).ShouldNot(HaveOccurred())
+			if i%2 == 0 {
+				Expect(store.Delete(key)).ShouldNot(HaveOccurred())
+			}
+		}
+		close(done)
+		wait.Wait()
+		Expect(store.ReferencedKeys("root")).Should(HaveLen(250))
+	})
+})
@@ -22,45 +22,290 @@
 package relation
 
 import (
+	"context"
 	"fmt"
+	"reflect"
+	"sort"
 	"sync"
+	"time"
 
 	mapset "github.com/deckarep/golang-set"
+
+	"github.com/firemiles/go-cache/pkg/types"
 )
 
 type RelationStore interface {
 	Add(key string, obj interface{}) error
 	Update(key string, obj interface{}) error
+	// UpdateWithTTL stores obj until ttl elapses, see DefaultExpiration and
+	// NoExpiration.
+	UpdateWithTTL(key string, obj interface{}, ttl time.Duration) error
+	// DeleteExpired deletes the expired objects, unless they are strongly
+	// referenced, and returns their keys.
+	DeleteExpired() []string
+	// SetCollectable marks key as collectable, or unmarks it, see RunGC.
+	SetCollectable(key string, collectable bool) error
+	// RunGC collects the objects which are collectable and unreferenced, or
+	// without owner, for the grace period, and returns their keys.
+	RunGC() []string
 	Delete(key string) error
 	List() []interface{}
 	ListKeys() []string
 	Get(key string) (item interface{}, exists bool)
-	Replace(items map[string]interface{}) error
+	// GetWithVersion also returns the version the object was stored at.
+	GetWithVersion(key string) (item interface{}, version uint64, exists bool)
+	// UpdateIfVersion updates key only if its version is expectedVersion, 0
+	// standing for no object, else it returns a ConflictError.
+	UpdateIfVersion(key string, obj interface{}, expectedVersion uint64) error
+	// Replace swaps in items and rebuilds the relations from them, it reports
+	// how items differ from the previous contents of the store.
+	Replace(items map[string]interface{}) (ReplaceDelta, error)
 	Referenced(key string) ([]interface{}, error)
 	ReferencedKeys(key string) ([]string, error)
 	ReferKeys(key string) ([]string, error)
+	UnresolvedKeys() []string
+	Index(indexName string, obj interface{}) ([]interface{}, error)
+	IndexKeys(indexName, indexedValue string) ([]string, error)
+	ListIndexFuncValues(indexName string) []string
+	ByIndex(indexName, indexedValue string) ([]interface{}, error)
+	GetIndexers() types.Indexers
+	AddIndexers(newIndexers types.Indexers) error
+	// Watch sends the events of the mutations matching filter until ctx is
+	// done.
+	Watch(ctx context.Context, filter func(Event) bool, opts ...WatchOption) (<-chan Event, error)
+	// ListWithVersion lists the objects along with the version of the store.
+	ListWithVersion() ([]interface{}, uint64)
+	// Commit applies ops at once, the store is left unchanged if any of them
+	// fails or the result breaks a constraint.
+	Commit(ops []TxnOp) error
+	// Refers lists the refers of key along with their kinds.
+	Refers(key string) ([]Refer, error)
+	// ReferKeysOfKind lists the keys key refers to with kind.
+	ReferKeysOfKind(key string, kind string) ([]string, error)
+	// ReferencedKeysOfKind lists the keys referring to key with kind.
+	ReferencedKeysOfKind(key string, kind string) ([]string, error)
+	// ReferencedOfKind lists the objects referring to key with kind.
+	ReferencedOfKind(key string, kind string) ([]interface{}, error)
+	// DanglingKeys lists the keys which are referred to but not stored.
+	DanglingKeys() []string
+	// DanglingRefers lists the refers of key which are not stored.
+	DanglingRefers(key string) ([]string, error)
+	// TransitiveReferKeys lists the keys key refers to directly or indirectly,
+	// following at most maxDepth references if maxDepth is positive.
+	TransitiveReferKeys(key string, maxDepth int) ([]ReachedKey, error)
+	// TransitiveReferencedKeys lists the keys referring to key directly or
+	// indirectly, following at most maxDepth references if maxDepth is positive.
+	TransitiveReferencedKeys(key string, maxDepth int) ([]ReachedKey, error)
+	// FindCycles lists the strongly connected components of the relations
+	// which contain a reference cycle.
+	FindCycles() [][]string
+	// TopologicalKeys orders the stored keys so each key comes after the keys
+	// it refers to.
+	TopologicalKeys() ([]string, error)
+	// TopologicalKeysFrom orders like TopologicalKeys the roots and the keys
+	// they refer to directly or indirectly.
+	TopologicalKeysFrom(roots []string) ([]string, error)
+	// DeleteCascade deletes key and, depending on propagation, the objects
+	// referring to it, it returns the deleted keys in deletion order.
+	DeleteCascade(key string, propagation DeletionPropagation) ([]string, error)
+	// Snapshot returns a read-only view of the store frozen at the time of the
+	// call.
+	Snapshot() StoreSnapshot
+}
+
+// ReplaceDelta describes the keys touched by a Replace.
+type ReplaceDelta struct {
+	// Added are the keys which weren't stored before.
+	Added []string
+	// Removed are the keys which aren't stored anymore.
+	Removed []string
+	// Changed are the keys stored before with a different object.
+	Changed []string
+}
+
+// unchangedVersions maps the keys Replace leaves unchanged to their version.
+func (t *threadSafeMap) unchangedVersions(items map[string]interface{}, delta ReplaceDelta) map[string]uint64 {
+	touched := make(map[string]bool, len(delta.Added)+len(delta.Changed))
+	for _, key := range delta.Added {
+		touched[key] = true
+	}
+	for _, key := range delta.Changed {
+		touched[key] = true
+	}
+	versions := make(map[string]uint64, len(items)-len(touched))
+	for key := range items {
+		if !touched[key] {
+			versions[key] = t.version(key)
+		}
+	}
+	return versions
+}
+
+func newReplaceDelta(oldItems storage, newItems map[string]interface{}) ReplaceDelta {
+	var delta ReplaceDelta
+	for key, newObj := range newItems {
+		oldObj, exists := oldItems.item(key)
+		if !exists {
+			delta.Added = append(delta.Added, key)
+		} else if !reflect.DeepEqual(oldObj, newObj) {
+			delta.Changed = append(delta.Changed, key)
+		}
+	}
+	oldItems.eachItem(func(key string, _ interface{}) {
+		if _, exists := newItems[key]; !exists {
+			delta.Removed = append(delta.Removed, key)
+		}
+	})
+	sort.Strings(delta.Added)
+	sort.Strings(delta.Removed)
+	sort.Strings(delta.Changed)
+	return delta
 }
 
 type relation struct {
-	referenced mapset.Set
-	refers     mapset.Set
+	referenced keySet
+	refers     keySet
+	// referKinds maps a refer to the kinds it is referred to with, there is
+	// no entry for a refer of the DefaultReferKind only.
+	referKinds map[string]mapset.Set
+	// indexed maps an index name to the values key is indexed with.
+	indexed map[string][]string
+	// unresolved is the error given by the ReferFunc when the object was
+	// stored without refers.
+	unresolved error
+	// version is the version of the store when the object was stored.
+	version uint64
+	// expires is the time in nanoseconds the object expires at, 0 if never.
+	expires int64
+	// collectable is set by SetCollectable.
+	collectable bool
+	// orphaned is the time in nanoseconds nothing referred to the object
+	// anymore, or its last owner was deleted, 0 while referred to. It is only
+	// kept while objects may be collected.
+	orphaned int64
+	// edit is the writer which may modify the relation in place, see
+	// storage.edit.
+	edit *edit
+}
+
+// fork copies r for the writer of edit e.
+func (r *relation) fork(e *edit) *relation {
+	c := *r
+	c.edit = e
+	if r.referenced != nil {
+		c.referenced = r.referenced.fork(e)
+	}
+	if r.refers != nil {
+		c.refers = r.refers.fork(e)
+	}
+	if r.referKinds != nil {
+		c.referKinds = make(map[string]mapset.Set, len(r.referKinds))
+		for refKey, kinds := range r.referKinds {
+			c.referKinds[refKey] = kinds.Clone()
+		}
+	}
+	// indexed is replaced as a whole, never modified
+	return &c
+}
+
+// storage holds the items and the relations of a store.
+type storage interface {
+	item(key string) (interface{}, bool)
+	setItem(key string, obj interface{})
+	deleteItem(key string)
+	// relation gives the relation of key, or nil if there is none, it must
+	// not be modified.
+	relation(key string) *relation
+	// edit gives the relation of key, or nil if there is none, for the caller
+	// to modify.
+	edit(key string) *relation
+	setRelation(key string, relat *relation)
+	deleteRelation(key string)
+	// newSet makes an empty set for the relations.
+	newSet() keySet
+	// newIndex makes an empty index.
+	newIndex() index
+	// len counts the stored items.
+	len() int
+	// eachItem calls f for every stored item.
+	eachItem(f func(key string, obj interface{}))
+	// eachRelation calls f for every relation.
+	eachRelation(f func(key string, relat *relation))
+	// empty makes an empty storage of the same kind, with room for size
+	// items if it can.
+	empty(size int) storage
+	// replace swaps the contents for the ones of next, made by empty.
+	replace(next storage)
+	// view returns a storage sharing the contents, for a snapshot to read
+	// until detach is called.
+	view() storage
+	// detach copies the contents shared with the views, which keep the
+	// current ones.
+	detach()
 }
 
 type threadSafeMap struct {
-	lock  sync.RWMutex
-	items map[string]interface{}
+	// lock guards the whole store, it is the lock of every shard.
+	lock rwLocker
+	// store holds the items and the relations mapping a key to a relation.
+	store     storage
+	referFunc TypedReferFunc
+	options   *options
+
+	// indexers maps an index name to its IndexFunc
+	indexers types.Indexers
+	// indices maps an index name to an index
+	indices map[string]index
+
+	broadcaster *broadcaster
 
-	// relations maps a key to an relation
-	relations map[string]*relation
-	referFunc ReferFunc
+	// shared counts the snapshots sharing store.
+	shared *sharing
+
+	// evictor keeps the store within its bounds, if it has any.
+	evictor *evictor
+
+	// marked is set once a key is marked collectable.
+	marked int32
+	// orphans are the keys left unreferenced by the write holding the lock.
+	orphans []string
+
+	// indexLock guards the indices against writers holding distinct shards.
+	indexLock sync.Mutex
+
+	// pending are the callbacks to run once the write lock is released.
+	pending     []func()
+	pendingLock sync.Mutex
+
+	// keepExpired is set by the snapshots, the expired objects are listed
+	// until they are deleted.
+	keepExpired bool
 }
 
 // NewThreadSafeMap ...
-func NewThreadSafeMap(referFunc ReferFunc) RelationStore {
+func NewThreadSafeMap(referFunc ReferFunc, opts ...Option) RelationStore {
+	shards := newShards(1)
+	return newThreadSafeMap(referFunc, shards, shards, newOptions(opts))
+}
+
+func newThreadSafeMap(referFunc ReferFunc, store storage, lock rwLocker, options *options) *threadSafeMap {
 	t := new(threadSafeMap)
-	t.items = make(map[string]interface{})
-	t.relations = make(map[string]*relation)
-	t.referFunc = referFunc
+	t.store = store
+	t.lock = &snapshotLock{rwLocker: lock, t: t}
+	t.shared = new(sharing)
+	t.evictor = newEvictor(options)
+	t.options = options
+	t.broadcaster = newBroadcaster(t.options.watchHistory)
+	t.indexers = make(types.Indexers, len(t.options.indexers))
+	t.indices = make(map[string]index, len(t.options.indexers))
+	for name, indexFunc := range t.options.indexers {
+		t.indexers[name] = indexFunc
+		t.indices[name] = store.newIndex()
+	}
+	t.referFunc = t.options.typedReferFunc
+	if t.referFunc == nil {
+		t.referFunc = referFunc.typed()
+	}
 	return t
 }
 
@@ -69,22 +314,81 @@ func (t *threadSafeMap) Add(key string, obj interface{}) error {
 }
 
 func (t *threadSafeMap) Update(key string, obj interface{}) error {
+	return t.UpdateWithTTL(key, obj, DefaultExpiration)
+}
+
+func (t *threadSafeMap) UpdateWithTTL(key string, obj interface{}, ttl time.Duration) error {
+	refers, unresolved, err := t.refers(key, obj)
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.unlock()
+
+	return t.update(key, obj, refers, unresolved, ttl)
+}
+
+func (t *threadSafeMap) UpdateIfVersion(key string, obj interface{}, expectedVersion uint64) error {
+	refers, unresolved, err := t.refers(key, obj)
+	if err != nil {
+		return err
+	}
+
 	t.lock.Lock()
-	defer t.lock.Unlock()
+	defer t.unlock()
+
+	if version := t.version(key); version != expectedVersion {
+		return ConflictError{Key: key, Expected: expectedVersion, Actual: version}
+	}
+	return t.update(key, obj, refers, unresolved, DefaultExpiration)
+}
 
-	oldObj := t.items[key]
-	t.items[key] = obj
-	t.updateRelation(oldObj, obj, key)
+// update stores obj under key for ttl once its refers are calculated.
+func (t *threadSafeMap) update(key string, obj interface{}, refers []Refer, unresolved error, ttl time.Duration) error {
+	if t.options.rejectCycles {
+		if cycle := t.cycleThrough(key, refers); cycle != nil {
+			return CycleError{Cycle: cycle}
+		}
+	}
+	values, err := indexValues(t.indexers, obj)
+	if err != nil {
+		return err
+	}
+	expires := t.expiry(ttl)
+	if err := t.log(walRecord{op: walPut, key: key, obj: obj, expires: expires}); err != nil {
+		return err
+	}
+	event := Event{Type: Updated, Key: key, Object: obj}
+	if oldObj, exists := t.store.item(key); exists {
+		event.OldObject = oldObj
+	} else {
+		event.Type = Added
+		t.resolveDangling(key)
+	}
+	t.putItem(key, obj, refers, unresolved, values)
+	t.store.edit(key).expires = expires
+	t.store.edit(key).version = t.broadcaster.publish(event)
+	t.notifyReferrers(key, event.Type)
+	t.evict(key)
 	return nil
 }
 
 func (t *threadSafeMap) Delete(key string) error {
 	t.lock.Lock()
-	defer t.lock.Unlock()
+	defer t.unlock()
 
-	if obj, exists := t.items[key]; exists {
-		t.deleteFromRelation(obj, key)
-		delete(t.items, key)
+	if _, exists := t.store.item(key); exists {
+		if referrers := t.strongReferrers(key); len(referrers) > 0 {
+			return ReferencedError{Key: key, Referrers: referrers}
+		}
+		if err := t.unblockOwner(key); err != nil {
+			return err
+		}
+		if err := t.deleteItem(key); err != nil {
+			return err
+		}
+		t.notifyReferrers(key, Deleted)
 	}
 	return nil
 }
@@ -93,10 +397,13 @@ func (t *threadSafeMap) List() []interface{} {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
-	list := make([]interface{}, 0, len(t.items))
-	for _, item := range t.items {
-		list = append(list, item)
-	}
+	live := t.unexpired()
+	list := make([]interface{}, 0, t.store.len())
+	t.store.eachItem(func(key string, item interface{}) {
+		if live(key) {
+			list = append(list, item)
+		}
+	})
 	return list
 }
 
@@ -104,47 +411,138 @@ func (t *threadSafeMap) ListKeys() []string {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
-	list := make([]string, 0, len(t.items))
-	for key := range t.items {
-		list = append(list, key)
-	}
+	live := t.unexpired()
+	list := make([]string, 0, t.store.len())
+	t.store.eachItem(func(key string, _ interface{}) {
+		if live(key) {
+			list = append(list, key)
+		}
+	})
 	return list
 }
 
 func (t *threadSafeMap) Get(key string) (item interface{}, exists bool) {
+	item, _, exists = t.GetWithVersion(key)
+	return item, exists
+}
+
+// GetWithVersion deletes the object if it expired, see expireKey.
+func (t *threadSafeMap) GetWithVersion(key string) (item interface{}, version uint64, exists bool) {
 	t.lock.RLock()
-	defer t.lock.RUnlock()
+	item, version, exists, expired := t.lookup(key)
+	t.lock.RUnlock()
 
-	item, exists = t.items[key]
-	return item, exists
+	if expired && t.expireKey(key) {
+		return nil, 0, false
+	}
+	if exists {
+		t.accessed(key)
+	}
+	return item, version, exists
 }
 
-func (t *threadSafeMap) Replace(items map[string]interface{}) error {
+// version gives the version key was stored at, or 0 if it isn't stored.
+func (t *threadSafeMap) version(key string) uint64 {
+	if _, exists := t.store.item(key); !exists {
+		return 0
+	}
+	return t.store.relation(key).version
+}
+
+func (t *threadSafeMap) Replace(items map[string]interface{}) (ReplaceDelta, error) {
+	// The relations are built before taking the lock, readers keep seeing the
+	// old contents until the shards are swapped.
+	next := t.store.empty(len(items))
+	for key, obj := range items {
+		refers, unresolved, err := t.refers(key, obj)
+		if err != nil {
+			return ReplaceDelta{}, err
+		}
+		next.setItem(key, obj)
+		linkRefers(next, key, refers, unresolved)
+	}
+
 	t.lock.Lock()
-	defer t.lock.Unlock()
+	defer t.unlock()
+
+	values := make(map[string]map[string][]string, len(items))
+	expires := t.expiry(DefaultExpiration)
+	for key, obj := range items {
+		v, err := indexValues(t.indexers, obj)
+		if err != nil {
+			return ReplaceDelta{}, err
+		}
+		values[key] = v
+		relat := next.edit(key)
+		relat.indexed = v
+		relat.expires = expires
+		// the kept objects stay marked collectable
+		if old := t.store.relation(key); old != nil {
+			relat.collectable = old.collectable
+			relat.orphaned = old.orphaned
+		}
+	}
 
-	t.items = items
-	t.relations = make(map[string]*relation)
-	return nil
+	delta := newReplaceDelta(t.store, items)
+	unchanged := t.unchangedVersions(items, delta)
+	// unchanged objects keep their TTL, the default one is for the others
+	for key := range unchanged {
+		next.edit(key).expires = t.store.relation(key).expires
+	}
+	dangling := t.danglingKeys()
+	if err := t.log(walRecord{op: walReplace, items: items, expires: expires}); err != nil {
+		return ReplaceDelta{}, err
+	}
+	t.store.replace(next)
+	t.indices = buildIndices(t.store.newIndex, t.indexers, values)
+	version := t.broadcaster.publish(Event{Type: Replaced, Delta: &delta})
+	for key := range items {
+		t.store.edit(key).version = version
+	}
+	// unchanged objects keep the version they were stored at
+	for key, oldVersion := range unchanged {
+		t.store.edit(key).version = oldVersion
+	}
+	for _, key := range delta.Added {
+		t.notifyReferrers(key, Added)
+	}
+	for _, key := range delta.Changed {
+		t.notifyReferrers(key, Updated)
+	}
+	for _, key := range delta.Removed {
+		t.notifyReferrers(key, Deleted)
+	}
+	for _, key := range dangling {
+		if _, exists := t.store.item(key); exists {
+			t.resolveDangling(key)
+		}
+	}
+	if t.gcEnabled() {
+		t.orphanedByReplace(items)
+	}
+	if t.evictor != nil {
+		t.evictor.replaced(items, delta)
+		t.evict()
+	}
+	return delta, nil
 }
 
 func (t *threadSafeMap) Referenced(key string) ([]interface{}, error) {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
-	relation, exists := t.relations[key]
-	if !exists {
+	relation := t.store.relation(key)
+	if relation == nil {
 		return nil, fmt.Errorf("relation of key %s not found", key)
 	}
 	if relation.referenced == nil {
 		return nil, nil
 	}
 	var list []interface{}
-	for i := range relation.referenced.Iter() {
-		key := i.(string)
-		obj, exists := t.items[key]
+	for _, key := range relation.referenced.keys() {
+		obj, exists := t.store.item(key)
 		if !exists {
-			panic(fmt.Errorf("item %s not found", key))
+			return nil, fmt.Errorf("item %s not found", key)
 		}
 		list = append(list, obj)
 	}
@@ -155,94 +553,341 @@ func (t *threadSafeMap) ReferencedKeys(key string) ([]string, error) {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
-	relation, exists := t.relations[key]
-	if !exists {
+	return t.referencedKeys(key)
+}
+
+func (t *threadSafeMap) referencedKeys(key string) ([]string, error) {
+	relation := t.store.relation(key)
+	if relation == nil {
 		return nil, fmt.Errorf("relation of key %s not found", key)
 	}
 	if relation.referenced == nil {
 		return nil, nil
 	}
-	var list []string
-	for i := range relation.referenced.Iter() {
-		key := i.(string)
-		list = append(list, key)
-	}
-	return list, nil
-
+	return relation.referenced.keys(), nil
 }
 
 func (t *threadSafeMap) ReferKeys(key string) ([]string, error) {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
-	relation, exists := t.relations[key]
-	if !exists {
+	return t.referKeys(key)
+}
+
+func (t *threadSafeMap) referKeys(key string) ([]string, error) {
+	relation := t.store.relation(key)
+	if relation == nil {
 		return nil, fmt.Errorf("relation of key %s no found", key)
 	}
 	if relation.refers == nil {
 		return nil, nil
 	}
+	return relation.refers.keys(), nil
+}
+
+func (t *threadSafeMap) DanglingKeys() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.danglingKeys()
+}
+
+func (t *threadSafeMap) DanglingRefers(key string) ([]string, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	relation := t.store.relation(key)
+	if relation == nil {
+		return nil, fmt.Errorf("relation of key %s not found", key)
+	}
+	if relation.refers == nil {
+		return nil, nil
+	}
 	var list []string
-	for refer := range relation.refers.Iter() {
-		r := refer.(string)
-		list = append(list, r)
+	for _, refKey := range sortedKeys(relation.refers) {
+		if _, exists := t.store.item(refKey); !exists {
+			list = append(list, refKey)
+		}
 	}
 	return list, nil
 }
 
-func (t *threadSafeMap) updateRelation(oldObj interface{}, newObj interface{}, key string) {
-	if oldObj != nil {
-		t.deleteRefersFromRelation(oldObj, key)
+// danglingKeys lists in order the keys which are referred to but not stored.
+func (t *threadSafeMap) danglingKeys() []string {
+	var list []string
+	t.store.eachRelation(func(key string, _ *relation) {
+		if _, exists := t.store.item(key); !exists {
+			list = append(list, key)
+		}
+	})
+	sort.Strings(list)
+	return list
+}
+
+// resolveDangling queues the dangling resolved callback for key, which was not
+// stored so far, if anything refers to it.
+func (t *threadSafeMap) resolveDangling(key string) {
+	if t.options.danglingResolved == nil {
+		return
 	}
-	refers, err := t.referFunc(newObj)
-	if err != nil {
-		panic(fmt.Errorf("unable to calculate refers for key %q: %v", key, err))
+	relat := t.store.relation(key)
+	if relat == nil || relat.referenced == nil || relat.referenced.len() == 0 {
+		return
 	}
-	curRelation, exist := t.relations[key]
-	if !exist {
-		curRelation = new(relation)
-		t.relations[key] = curRelation
+	referrers := sortedKeys(relat.referenced)
+	t.queue(func() {
+		t.options.danglingResolved(key, referrers)
+	})
+}
+
+// notifyReferrers queues the referent changed callback for every object referring
+// to key.
+func (t *threadSafeMap) notifyReferrers(key string, eventType EventType) {
+	if t.options.referentChanged == nil {
+		return
 	}
-	if len(refers) == 0 {
+	relat := t.store.relation(key)
+	if relat == nil || relat.referenced == nil {
 		return
 	}
-	if curRelation.refers == nil {
-		curRelation.refers = mapset.NewThreadUnsafeSet()
+	for _, referrer := range sortedKeys(relat.referenced) {
+		if referrer == key {
+			continue
+		}
+		change := ReferentChange{Referrer: referrer, Referent: key, Type: eventType}
+		t.queue(func() {
+			t.options.referentChanged(change)
+		})
+	}
+}
+
+// unlock collects the keys orphaned by the write and releases the write lock,
+// then runs the callbacks queued while it was held, so callbacks are free to
+// use the store again.
+func (t *threadSafeMap) unlock() {
+	t.collect()
+	t.lock.Unlock()
+	t.runPending()
+}
+
+// queue queues f to run once the write lock is released.
+func (t *threadSafeMap) queue(f func()) {
+	t.pendingLock.Lock()
+	t.pending = append(t.pending, f)
+	t.pendingLock.Unlock()
+}
+
+// runPending runs the queued callbacks.
+func (t *threadSafeMap) runPending() {
+	t.pendingLock.Lock()
+	pending := t.pending
+	t.pending = nil
+	t.pendingLock.Unlock()
+	for _, f := range pending {
+		f()
+	}
+}
+
+func (t *threadSafeMap) UnresolvedKeys() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var list []string
+	t.store.eachRelation(func(key string, relation *relation) {
+		if relation.unresolved != nil {
+			list = append(list, key)
+		}
+	})
+	sort.Strings(list)
+	return list
+}
+
+// refers calculates the refers of obj before the store is touched, so a failing
+// ReferFunc never leaves the store half updated. If unresolved refers are
+// allowed the ReferFunc error is handed back as unresolved instead.
+func (t *threadSafeMap) refers(key string, obj interface{}) (refers []Refer, unresolved error, err error) {
+	refers, err = t.referFunc(obj)
+	if err == nil {
+		return refers, nil, nil
+	}
+	if t.options.unresolvedRefers {
+		return nil, err, nil
 	}
-	curRelation.refers.Clear()
-	for _, refKey := range refers {
-		curRelation.refers.Add(refKey)
-		refRelation, exist := t.relations[refKey]
-		if !exist {
+	return nil, nil, RefersError{Key: key, Obj: obj, Err: err}
+}
+
+func (t *threadSafeMap) updateRelation(key string, refers []Refer, unresolved error) {
+	if curRelation := t.store.edit(key); curRelation != nil {
+		t.deleteRefersFromRelation(key, curRelation)
+	}
+	linkRefers(t.store, key, refers, unresolved)
+}
+
+// linkRefers records the refers of key in the relations of s, key must have no
+// refers recorded yet.
+func linkRefers(s storage, key string, refers []Refer, unresolved error) {
+	curRelation := s.edit(key)
+	if curRelation == nil {
+		curRelation = new(relation)
+		s.setRelation(key, curRelation)
+	}
+	curRelation.unresolved = unresolved
+	if len(refers) > 0 && curRelation.refers == nil {
+		curRelation.refers = s.newSet()
+	}
+	for _, refer := range refers {
+		if !curRelation.addRefer(refer) {
+			continue
+		}
+		refKey := refer.Key
+		refRelation := s.edit(refKey)
+		if refRelation == nil {
 			refRelation = new(relation)
-			t.relations[refKey] = refRelation
+			s.setRelation(refKey, refRelation)
 		}
 		if refRelation.referenced == nil {
-			refRelation.referenced = mapset.NewThreadUnsafeSet()
+			refRelation.referenced = s.newSet()
 		}
-		refRelation.referenced.Add(key)
+		refRelation.referenced.add(key)
+		refRelation.orphaned = 0
 	}
 }
 
-func (t *threadSafeMap) deleteFromRelation(obj interface{}, key string) {
-	t.deleteRefersFromRelation(obj, key)
-	delete(t.relations, key)
+// strongReferrers returns the sorted referrers holding a strong reference to key.
+func (t *threadSafeMap) strongReferrers(key string) []string {
+	if t.options.strong == nil && len(t.options.strongKinds) == 0 {
+		return nil
+	}
+	relat := t.store.relation(key)
+	if relat == nil || relat.referenced == nil {
+		return nil
+	}
+	var referrers []string
+	for _, referrer := range sortedKeys(relat.referenced) {
+		// an object referring to itself never blocks its own deletion
+		if referrer != key && t.isStrong(referrer, key) {
+			referrers = append(referrers, referrer)
+		}
+	}
+	return referrers
 }
 
-func (t *threadSafeMap) deleteRefersFromRelation(obj interface{}, key string) {
-	refers, err := t.referFunc(obj)
-	if err != nil {
-		panic(fmt.Errorf("unable to calculate refers for key %q: %v", key, err))
+// deleteItem removes key and reports it, the caller checks it exists.
+func (t *threadSafeMap) deleteItem(key string) error {
+	if err := t.log(walRecord{op: walDelete, key: key}); err != nil {
+		return err
+	}
+	obj, _ := t.store.item(key)
+	t.removeItem(key)
+	t.broadcaster.publish(Event{Type: Deleted, Key: key, Object: obj})
+	return nil
+}
+
+// putItem stores obj under key along with its refers and indexed values.
+func (t *threadSafeMap) putItem(key string, obj interface{}, refers []Refer, unresolved error, values map[string][]string) {
+	_, existed := t.store.item(key)
+	if t.evictor != nil {
+		t.evictor.put(key, obj, existed)
+	}
+	t.store.setItem(key, obj)
+	t.updateRelation(key, refers, unresolved)
+	t.updateIndices(key, values)
+	if !existed && t.gcEnabled() {
+		if relat := t.store.edit(key); relat.referenced == nil || relat.referenced.len() == 0 || t.isOwnerless(key, nil) {
+			relat.orphaned = t.options.now().UnixNano()
+		}
+	}
+}
+
+// removeItem removes key along with its refers and indexed values, the caller
+// checks it exists.
+func (t *threadSafeMap) removeItem(key string) {
+	if t.evictor != nil {
+		t.evictor.remove(key)
+	}
+	if t.options.ownerGC {
+		t.ownerRemoved(key)
 	}
-	for _, refKey := range refers {
-		relat, exist := t.relations[refKey]
-		if !exist {
+	t.deleteFromIndices(key)
+	t.deleteFromRelation(key)
+	t.store.deleteItem(key)
+}
+
+// isStrong tells if the reference from referrer to referent is strong.
+func (t *threadSafeMap) isStrong(referrer, referent string) bool {
+	if t.options.strong != nil && t.options.strong(referrer, referent) {
+		return true
+	}
+	for kind := range t.options.strongKinds {
+		if t.store.relation(referrer).refersWithKind(referent, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteFromRelation drops the refers of key, the relation itself is kept as
+// long as key is referred to, key is dangling then.
+func (t *threadSafeMap) deleteFromRelation(key string) {
+	relat := t.store.edit(key)
+	if relat == nil {
+		return
+	}
+	t.deleteRefersFromRelation(key, relat)
+	relat.unresolved = nil
+	relat.version = 0
+	relat.collectable = false
+	if relat.referenced == nil || relat.referenced.len() == 0 {
+		t.store.deleteRelation(key)
+	}
+}
+
+// deleteRefersFromRelation drops the refers recorded for key, so the refers
+// are removed exactly as they were added even if the object was modified since.
+// curRelation is the relation of key given by storage.edit.
+func (t *threadSafeMap) deleteRefersFromRelation(key string, curRelation *relation) {
+	if curRelation.refers == nil {
+		return
+	}
+	for _, refKey := range curRelation.refers.keys() {
+		relat := t.store.edit(refKey)
+		if relat == nil {
 			continue
 		}
 		if relat.referenced == nil {
 			continue
 		}
-		relat.referenced.Remove(key)
+		relat.referenced.remove(key)
+		if relat.referenced.len() > 0 {
+			continue
+		}
+		if _, stored := t.store.item(refKey); stored {
+			t.orphaned(refKey, relat)
+		} else {
+			// forget dangling keys nobody refers to anymore
+			t.store.deleteRelation(refKey)
+		}
 	}
+	curRelation.refers = nil
+	curRelation.referKinds = nil
 }
 
+// sortedSet lists the keys of a set in order.
+func sortedSet(set mapset.Set) []string {
+	keys := make([]string, 0, set.Cardinality())
+	for i := range set.Iter() {
+		keys = append(keys, i.(string))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// log records a mutation in the write-ahead log if there is one, the caller
+// holds the lock of the mutated keys and applies the mutation only if it is
+// logged.
+func (t *threadSafeMap) log(rec walRecord) error {
+	if t.options.wal != nil {
+		return t.options.wal.append(rec)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"container/heap"
+	"fmt"
+)
+
+func (t *threadSafeMap) TopologicalKeys() ([]string, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	nodes := make(map[string]bool, t.store.len())
+	t.store.eachItem(func(key string, _ interface{}) {
+		nodes[key] = true
+	})
+	return t.topologicalOrder(nodes)
+}
+
+func (t *threadSafeMap) TopologicalKeysFrom(roots []string) ([]string, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	nodes := make(map[string]bool)
+	for _, root := range roots {
+		if _, exists := t.store.item(root); !exists {
+			return nil, fmt.Errorf("item %s not found", root)
+		}
+		if nodes[root] {
+			continue
+		}
+		nodes[root] = true
+		for _, reached := range t.reachStored(root) {
+			nodes[reached] = true
+		}
+	}
+	return t.topologicalOrder(nodes)
+}
+
+// reachStored lists the stored keys key refers to directly or indirectly through
+// stored keys.
+func (t *threadSafeMap) reachStored(key string) []string {
+	var list []string
+	visited := map[string]bool{key: true}
+	for stack := []string{key}; len(stack) > 0; {
+		cur := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		relat := t.store.relation(cur)
+		if relat == nil || relat.refers == nil {
+			continue
+		}
+		for _, refKey := range relat.refers.keys() {
+			if _, exists := t.store.item(refKey); !exists || visited[refKey] {
+				continue
+			}
+			visited[refKey] = true
+			list = append(list, refKey)
+			stack = append(stack, refKey)
+		}
+	}
+	return list
+}
+
+// topologicalOrder orders nodes so every key comes after the keys it refers to,
+// breaking ties by key to give a stable order. References leaving nodes are
+// ignored.
+func (t *threadSafeMap) topologicalOrder(nodes map[string]bool) ([]string, error) {
+	pending := make(map[string]int, len(nodes))
+	ready := &keyHeap{}
+	for key := range nodes {
+		relat := t.store.relation(key)
+		if relat != nil && relat.refers != nil {
+			for _, refKey := range relat.refers.keys() {
+				if nodes[refKey] {
+					pending[key]++
+				}
+			}
+		}
+		if pending[key] == 0 {
+			heap.Push(ready, key)
+		}
+	}
+
+	order := make([]string, 0, len(nodes))
+	for ready.Len() > 0 {
+		key := heap.Pop(ready).(string)
+		order = append(order, key)
+		relat := t.store.relation(key)
+		if relat == nil || relat.referenced == nil {
+			continue
+		}
+		for _, referrer := range relat.referenced.keys() {
+			if !nodes[referrer] {
+				continue
+			}
+			pending[referrer]--
+			if pending[referrer] == 0 {
+				heap.Push(ready, referrer)
+			}
+		}
+	}
+	if len(order) < len(nodes) {
+		return nil, CycleError{Cycle: t.cycleAmong(nodes, pending)}
+	}
+	return order, nil
+}
+
+// cycleAmong finds a cycle among the nodes left pending by topologicalOrder,
+// every one of them refers to another pending node.
+func (t *threadSafeMap) cycleAmong(nodes map[string]bool, pending map[string]int) []string {
+	var start string
+	for key, n := range pending {
+		if n > 0 && (start == "" || key < start) {
+			start = key
+		}
+	}
+	position := make(map[string]int)
+	var path []string
+	for key := start; ; {
+		if i, seen := position[key]; seen {
+			return append(path[i:], key)
+		}
+		position[key] = len(path)
+		path = append(path, key)
+		for _, refKey := range sortedKeys(t.store.relation(key).refers) {
+			if nodes[refKey] && pending[refKey] > 0 {
+				key = refKey
+				break
+			}
+		}
+	}
+}
+
+// keyHeap is a min-heap of keys.
+type keyHeap []string
+
+func (h keyHeap) Len() int            { return len(h) }
+func (h keyHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h keyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x interface{}) { *h = append(*h, x.(string)) }
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
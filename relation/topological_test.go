@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Topological order", func() {
+	var c Cache
+
+	BeforeEach(func() {
+		c = NewCache(ObjectKey, ObjectRefers)
+		for _, obj := range []*Object{
+			newObject("app", "db", "cache"), newObject("db", "volume"), newObject("cache"),
+			newObject("volume", "missing"), newObject("job", "db"),
+		} {
+			Expect(c.Add(obj)).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("Order all keys", func() {
+		keys, err := c.TopologicalKeys()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keys).Should(Equal([]string{"cache", "volume", "db", "app", "job"}))
+		keys, err = c.ReverseTopologicalKeys()
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keys).Should(Equal([]string{"job", "app", "db", "volume", "cache"}))
+	})
+
+	It("Order subgraph", func() {
+		keys, err := c.TopologicalKeysFrom("job")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keys).Should(Equal([]string{"volume", "db", "job"}))
+		keys, err = c.ReverseTopologicalKeysFrom("job", "cache")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(keys).Should(Equal([]string{"job", "db", "volume", "cache"}))
+		_, err = c.TopologicalKeysFrom("missing")
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("Report cycle", func() {
+		Expect(c.Update(newObject("volume", "job"))).ShouldNot(HaveOccurred())
+		_, err := c.TopologicalKeys()
+		Expect(err).Should(Equal(CycleError{Cycle: []string{"db", "volume", "job", "db"}}))
+		_, err = c.TopologicalKeysFrom("cache")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+})
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"fmt"
+)
+
+// ReachedKey is a key found by a transitive query.
+type ReachedKey struct {
+	Key string
+	// Depth is the number of references followed to reach Key.
+	Depth int
+	// Path lists the keys from the queried key to Key, both included.
+	Path []string
+}
+
+func (t *threadSafeMap) TransitiveReferKeys(key string, maxDepth int) ([]ReachedKey, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.reach(key, maxDepth, func(r *relation) keySet {
+		return r.refers
+	})
+}
+
+func (t *threadSafeMap) TransitiveReferencedKeys(key string, maxDepth int) ([]ReachedKey, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.reach(key, maxDepth, func(r *relation) keySet {
+		return r.referenced
+	})
+}
+
+// reach walks the relations breadth first from key along the set picked by next,
+// so every key is reached by one of its shortest paths. A maxDepth less than 1
+// doesn't limit the walk.
+func (t *threadSafeMap) reach(key string, maxDepth int, next func(*relation) keySet) ([]ReachedKey, error) {
+	if t.store.relation(key) == nil {
+		return nil, fmt.Errorf("relation of key %s not found", key)
+	}
+	parents := map[string]string{key: ""}
+	var list []ReachedKey
+	level := []string{key}
+	for depth := 1; len(level) > 0 && (maxDepth < 1 || depth <= maxDepth); depth++ {
+		var nextLevel []string
+		for _, cur := range level {
+			relat := t.store.relation(cur)
+			if relat == nil || next(relat) == nil {
+				continue
+			}
+			for _, k := range sortedKeys(next(relat)) {
+				if _, seen := parents[k]; seen {
+					continue
+				}
+				parents[k] = cur
+				nextLevel = append(nextLevel, k)
+				list = append(list, ReachedKey{Key: k, Depth: depth, Path: pathTo(parents, key, k)})
+			}
+		}
+		level = nextLevel
+	}
+	return list, nil
+}
+
+// pathTo follows parents back from k to start.
+func pathTo(parents map[string]string, start, k string) []string {
+	var path []string
+	for ; k != start; k = parents[k] {
+		path = append(path, k)
+	}
+	path = append(path, start)
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transitive references", func() {
+	var c Cache
+	e := &Object{ID: "e"}
+	d := &Object{ID: "d", SubObjects: []*Object{e}}
+	b := &Object{ID: "b", SubObjects: []*Object{d}}
+	cc := &Object{ID: "c", SubObjects: []*Object{d}}
+	a := &Object{ID: "a", SubObjects: []*Object{b, cc}}
+
+	BeforeEach(func() {
+		c = NewCache(ObjectKey, ObjectRefers)
+		for _, obj := range []*Object{a, b, cc, d} {
+			Expect(c.Add(obj)).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("Refer keys", func() {
+		reached, err := c.TransitiveReferKeys(a.ID, 0)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(reached).Should(Equal([]ReachedKey{
+			{Key: "b", Depth: 1, Path: []string{"a", "b"}},
+			{Key: "c", Depth: 1, Path: []string{"a", "c"}},
+			{Key: "d", Depth: 2, Path: []string{"a", "b", "d"}},
+			{Key: "e", Depth: 3, Path: []string{"a", "b", "d", "e"}},
+		}))
+	})
+
+	It("Referenced keys with max depth", func() {
+		reached, err := c.TransitiveReferencedKeys(e.ID, 2)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(reached).Should(Equal([]ReachedKey{
+			{Key: "d", Depth: 1, Path: []string{"e", "d"}},
+			{Key: "b", Depth: 2, Path: []string{"e", "d", "b"}},
+			{Key: "c", Depth: 2, Path: []string{"e", "d", "c"}},
+		}))
+	})
+
+	It("Reference cycle", func() {
+		Expect(c.Update(&Object{ID: "d", SubObjects: []*Object{a}})).ShouldNot(HaveOccurred())
+		reached, err := c.TransitiveReferKeys(d.ID, 0)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(reached).Should(Equal([]ReachedKey{
+			{Key: "a", Depth: 1, Path: []string{"d", "a"}},
+			{Key: "b", Depth: 2, Path: []string{"d", "a", "b"}},
+			{Key: "c", Depth: 2, Path: []string{"d", "a", "c"}},
+		}))
+	})
+
+	It("Unknown key", func() {
+		_, err := c.TransitiveReferKeys("unknown", 0)
+		Expect(err).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/firemiles/go-cache/pkg/types"
+)
+
+const (
+	// DefaultExpiration stores an object for the TTL set by WithDefaultTTL.
+	DefaultExpiration time.Duration = 0
+	// NoExpiration stores an object until it is deleted.
+	NoExpiration time.Duration = -1
+)
+
+// expiry gives the time an object stored now for ttl expires at, 0 if never.
+func (t *threadSafeMap) expiry(ttl time.Duration) int64 {
+	if ttl == DefaultExpiration {
+		ttl = t.options.defaultTTL
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	return t.options.now().Add(ttl).UnixNano()
+}
+
+// isExpired tells if the object stored under key expired, the caller holds
+// the lock of key.
+func (t *threadSafeMap) isExpired(key string) bool {
+	relat := t.store.relation(key)
+	return relat.expires != 0 && relat.expires <= t.options.now().UnixNano()
+}
+
+// unexpired returns the filter of the keys Get wouldn't delete, for the listing
+// reads to hide the expired objects not deleted yet. The caller holds the read
+// lock. The objects of a snapshot never expire.
+func (t *threadSafeMap) unexpired() func(key string) bool {
+	if t.keepExpired {
+		return func(string) bool { return true }
+	}
+	now := t.options.now().UnixNano()
+	return func(key string) bool {
+		expires := t.store.relation(key).expires
+		return expires == 0 || expires > now || len(t.strongReferrers(key)) > 0
+	}
+}
+
+// unexpiredKeys drops the keys Get would delete from keys, in place.
+func (t *threadSafeMap) unexpiredKeys(keys []string) []string {
+	live := t.unexpired()
+	kept := keys[:0]
+	for _, key := range keys {
+		if live(key) {
+			kept = append(kept, key)
+		}
+	}
+	return kept
+}
+
+// restoreExpiry sets the expiry times of the stored keys, replayed from a log.
+func (t *threadSafeMap) restoreExpiry(expires map[string]int64) {
+	t.lock.Lock()
+	defer t.unlock()
+
+	for key, at := range expires {
+		if _, exists := t.store.item(key); exists {
+			t.store.edit(key).expires = at
+		}
+	}
+}
+
+// lookup gives the object stored under key and whether it expired, the caller
+// holds the lock of key.
+func (t *threadSafeMap) lookup(key string) (item interface{}, version uint64, exists, expired bool) {
+	item, exists = t.store.item(key)
+	if !exists {
+		return nil, 0, false, false
+	}
+	return item, t.store.relation(key).version, true, t.isExpired(key)
+}
+
+// expireKey deletes key if it is expired and not strongly referenced, it
+// tells if key is gone.
+func (t *threadSafeMap) expireKey(key string) bool {
+	t.lock.Lock()
+	defer t.unlock()
+
+	if _, exists := t.store.item(key); !exists {
+		return true
+	}
+	return t.expireItem(key)
+}
+
+// expireItem deletes key if it is expired and not strongly referenced, the
+// caller holds the write lock and checks key exists.
+func (t *threadSafeMap) expireItem(key string) bool {
+	if !t.isExpired(key) || len(t.strongReferrers(key)) > 0 {
+		return false
+	}
+	if t.log(walRecord{op: walDelete, key: key}) != nil {
+		return false
+	}
+	obj, _ := t.store.item(key)
+	t.removeItem(key)
+	t.broadcaster.publish(Event{Type: Expired, Key: key, Object: obj})
+	t.notifyReferrers(key, Expired)
+	return true
+}
+
+// DeleteExpired finds the expired objects under the read lock, an expired
+// object strongly referenced by another one expiring is deleted after it.
+func (t *threadSafeMap) DeleteExpired() []string {
+	t.lock.RLock()
+	var expired []string
+	t.store.eachItem(func(key string, _ interface{}) {
+		if t.isExpired(key) {
+			expired = append(expired, key)
+		}
+	})
+	t.lock.RUnlock()
+	if len(expired) == 0 {
+		return nil
+	}
+	sort.Strings(expired)
+
+	t.lock.Lock()
+	defer t.unlock()
+
+	var deleted []string
+	for progress := true; progress; {
+		progress = false
+		kept := expired[:0]
+		for _, key := range expired {
+			if _, exists := t.store.item(key); !exists {
+				continue
+			}
+			if t.expireItem(key) {
+				deleted = append(deleted, key)
+				progress = true
+			} else if t.isExpired(key) {
+				kept = append(kept, key)
+			}
+		}
+		expired = kept
+	}
+	return deleted
+}
+
+// janitor deletes the expired objects of a store periodically.
+type janitor struct {
+	stopOnce sync.Once
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func startJanitor(store RelationStore, interval time.Duration) *janitor {
+	j := &janitor{stop: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer close(j.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-j.stop:
+				return
+			case <-ticker.C:
+				store.DeleteExpired()
+				store.RunGC()
+			}
+		}
+	}()
+	return j
+}
+
+// Stop stops the janitor and waits for it to return.
+func (j *janitor) Stop() {
+	j.stopOnce.Do(func() {
+		close(j.stop)
+		<-j.stopped
+	})
+}
+
+func (c *cache) AddWithTTL(obj interface{}, ttl time.Duration) error {
+	key, err := c.keyFunc(obj)
+	if err != nil {
+		return types.KeyError{Obj: obj, Err: err}
+	}
+	return c.cacheStorage.UpdateWithTTL(key, obj, ttl)
+}
+
+func (c *cache) DeleteExpired() []string {
+	return c.cacheStorage.DeleteExpired()
+}
+
+func (c *cache) Stop() {
+	if c.janitor != nil {
+		c.janitor.Stop()
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"context"
+	"time"
+
+	"github.com/firemiles/go-cache/pkg/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TTL", func() {
+	BeforeEach(func() {
+		fakeNow = time.Unix(1600000000, 0)
+	})
+
+	forEachEngine(func(name string, opts []Option) {
+		opts = append(opts, fakeClock)
+
+		It("Expire objects of a "+name+" when they are got", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c := NewCache(ObjectKey, ObjectRefers, append(opts, WithDefaultTTL(time.Minute))...)
+			Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(newObject("b", "c"))).ShouldNot(HaveOccurred())
+			Expect(c.Add(newObject("c"))).ShouldNot(HaveOccurred())
+			Expect(c.AddWithTTL(newObject("a", "b"), NoExpiration)).ShouldNot(HaveOccurred())
+			events, err := c.Watch(ctx, nil)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			fakeNow = fakeNow.Add(time.Minute)
+			_, exists, err := c.GetByKey("b")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exists).Should(BeFalse())
+			Expect((<-events)).Should(Equal(Event{Type: Expired, Key: "b", Object: newObject("b", "c"), Version: 5}))
+
+			// c expired too, it is hidden until deleted
+			Expect(c.ListKeys()).Should(Equal([]string{"a"}))
+			Expect(c.ReferKeys("a")).Should(Equal([]string{"b"}))
+			Expect(c.DanglingKeys()).Should(Equal([]string{"b"}))
+			Expect(c.ReferencedKeys("c")).Should(BeEmpty())
+			_, exists, err = c.GetByKey("a")
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(exists).Should(BeTrue())
+		})
+
+		It("Hide the expired objects of a "+name+" from the listings", func() {
+			indexers := types.Indexers{"all": func(interface{}) ([]string, error) {
+				return []string{"all"}, nil
+			}}
+			c := NewCache(ObjectKey, ObjectRefers, append(opts, WithIndexers(indexers))...)
+			Expect(c.AddWithTTL(newObject("a"), time.Second)).ShouldNot(HaveOccurred())
+			Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+
+			fakeNow = fakeNow.Add(time.Second)
+			Expect(c.ListKeys()).Should(Equal([]string{"b"}))
+			Expect(c.List()).Should(Equal([]interface{}{newObject("b")}))
+			Expect(c.IndexKeys("all", "all")).Should(Equal([]string{"b"}))
+			Expect(c.ByIndex("all", "all")).Should(Equal([]interface{}{newObject("b")}))
+			Expect(c.Index("all", newObject("a"))).Should(Equal([]interface{}{newObject("b")}))
+			snapshot := c.Snapshot()
+			Expect(snapshot.ListKeys()).Should(ConsistOf("a", "b"))
+			snapshot.Release()
+			Expect(c.DeleteExpired()).Should(Equal([]string{"a"}))
+		})
+	})
+
+	It("Keep the TTL of the objects a resync leaves unchanged", func() {
+		start := fakeNow
+		c := NewCache(ObjectKey, ObjectRefers, fakeClock, WithDefaultTTL(time.Minute))
+		Expect(c.AddWithTTL(newObject("a"), time.Hour)).ShouldNot(HaveOccurred())
+		Expect(c.AddWithTTL(newObject("b"), NoExpiration)).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("c"))).ShouldNot(HaveOccurred())
+
+		fakeNow = fakeNow.Add(30 * time.Second)
+		Expect(c.Replace([]interface{}{newObject("a"), newObject("b"), newObject("c", "a"), newObject("d")})).ShouldNot(HaveOccurred())
+		// the changed and added objects get the default TTL from now on
+		fakeNow = start.Add(time.Minute)
+		Expect(c.DeleteExpired()).Should(BeEmpty())
+		fakeNow = fakeNow.Add(30 * time.Second)
+		Expect(c.DeleteExpired()).Should(Equal([]string{"c", "d"}))
+
+		fakeNow = start.Add(time.Hour)
+		Expect(c.DeleteExpired()).Should(Equal([]string{"a"}))
+		Expect(c.ListKeys()).Should(Equal([]string{"b"}))
+	})
+
+	It("Refresh the TTL on update", func() {
+		c := NewCache(ObjectKey, ObjectRefers, fakeClock)
+		Expect(c.AddWithTTL(newObject("a"), time.Minute)).ShouldNot(HaveOccurred())
+		Expect(c.AddWithTTL(newObject("b"), time.Minute)).ShouldNot(HaveOccurred())
+		fakeNow = fakeNow.Add(30 * time.Second)
+		Expect(c.AddWithTTL(newObject("a"), time.Minute)).ShouldNot(HaveOccurred())
+		// no default TTL, b never expires once updated without one
+		Expect(c.Update(newObject("b"))).ShouldNot(HaveOccurred())
+
+		fakeNow = fakeNow.Add(time.Minute)
+		Expect(c.DeleteExpired()).Should(Equal([]string{"a"}))
+		Expect(c.ListKeys()).Should(Equal([]string{"b"}))
+	})
+
+	It("Keep expired objects strongly referenced", func() {
+		c := NewCache(ObjectKey, ObjectRefers, fakeClock, WithStrongReferences())
+		Expect(c.AddWithTTL(newObject("a", "b"), time.Minute)).ShouldNot(HaveOccurred())
+		Expect(c.AddWithTTL(newObject("b"), time.Second)).ShouldNot(HaveOccurred())
+		Expect(c.AddWithTTL(newObject("c", "d"), NoExpiration)).ShouldNot(HaveOccurred())
+		Expect(c.AddWithTTL(newObject("d"), time.Second)).ShouldNot(HaveOccurred())
+
+		fakeNow = fakeNow.Add(time.Second)
+		_, exists, err := c.GetByKey("b")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(exists).Should(BeTrue())
+		Expect(c.DeleteExpired()).Should(BeEmpty())
+
+		fakeNow = fakeNow.Add(time.Minute)
+		Expect(c.DeleteExpired()).Should(Equal([]string{"a", "b"}))
+		Expect(c.ListKeys()).Should(ConsistOf("c", "d"))
+	})
+
+	It("Leave snapshots unchanged", func() {
+		c := NewCache(ObjectKey, ObjectRefers, fakeClock)
+		Expect(c.AddWithTTL(newObject("a"), time.Second)).ShouldNot(HaveOccurred())
+		snapshot := c.Snapshot()
+		defer snapshot.Release()
+
+		fakeNow = fakeNow.Add(time.Second)
+		Expect(snapshot.DeleteExpired()).Should(BeEmpty())
+		_, exists, err := snapshot.GetByKey("a")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(exists).Should(BeTrue())
+		Expect(c.DeleteExpired()).Should(Equal([]string{"a"}))
+	})
+
+	It("Delete expired objects in the background", func() {
+		c := NewCache(ObjectKey, ObjectRefers, WithJanitor(time.Millisecond))
+		defer c.Stop()
+		Expect(c.AddWithTTL(newObject("a"), time.Millisecond)).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b", "a"))).ShouldNot(HaveOccurred())
+		Eventually(c.ListKeys).Should(Equal([]string{"b"}))
+		Expect(c.DanglingKeys()).Should(Equal([]string{"a"}))
+		c.Stop()
+	})
+})
@@ -0,0 +1,274 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"errors"
+
+	"github.com/firemiles/go-cache/pkg/types"
+)
+
+// ErrTxnClosed is returned when using a transaction already committed or rolled
+// back.
+var ErrTxnClosed = errors.New("transaction is already committed or rolled back")
+
+// Txn batches mutations of a Cache, Commit applies them at once: readers see
+// either none or all of them. A Txn is not safe for concurrent use.
+type Txn interface {
+	Add(obj interface{}) error
+	Update(obj interface{}) error
+	Delete(obj interface{}) error
+	// Commit applies the mutations under a single lock, constraints such as
+	// strong references and cycle rejection are checked on the result only.
+	// Nothing is applied if it fails. A single Committed event groups the
+	// events of the mutations.
+	Commit() error
+	// Rollback drops the mutations.
+	Rollback()
+}
+
+// TxnOp is a mutation of a transaction.
+type TxnOp struct {
+	Key string
+	// Obj is the object to store, unless Delete is set.
+	Obj    interface{}
+	Delete bool
+}
+
+type txn struct {
+	cache  *cache
+	ops    []TxnOp
+	closed bool
+}
+
+func (t *txn) Add(obj interface{}) error {
+	return t.add(obj, false)
+}
+
+func (t *txn) Update(obj interface{}) error {
+	return t.add(obj, false)
+}
+
+func (t *txn) Delete(obj interface{}) error {
+	return t.add(obj, true)
+}
+
+func (t *txn) add(obj interface{}, del bool) error {
+	if t.closed {
+		return ErrTxnClosed
+	}
+	key, err := t.cache.keyFunc(obj)
+	if err != nil {
+		return types.KeyError{Obj: obj, Err: err}
+	}
+	op := TxnOp{Key: key, Delete: del}
+	if !del {
+		op.Obj = obj
+	}
+	t.ops = append(t.ops, op)
+	return nil
+}
+
+func (t *txn) Commit() error {
+	if t.closed {
+		return ErrTxnClosed
+	}
+	t.closed = true
+	if len(t.ops) == 0 {
+		return nil
+	}
+	return t.cache.cacheStorage.Commit(t.ops)
+}
+
+func (t *txn) Rollback() {
+	t.closed = true
+	t.ops = nil
+}
+
+// savedItem is the state of a key before a transaction touched it.
+type savedItem struct {
+	obj        interface{}
+	exists     bool
+	dangling   bool
+	refers     []Refer
+	unresolved error
+	indexed    map[string][]string
+	version    uint64
+	expires    int64
+	// collectable is only saved for the stored keys, deleting an object
+	// unmarks it.
+	collectable bool
+}
+
+func (t *threadSafeMap) Commit(ops []TxnOp) error {
+	refers := make([][]Refer, len(ops))
+	unresolved := make([]error, len(ops))
+	for i, op := range ops {
+		if op.Delete {
+			continue
+		}
+		var err error
+		if refers[i], unresolved[i], err = t.refers(op.Key, op.Obj); err != nil {
+			return err
+		}
+	}
+
+	t.lock.Lock()
+	defer t.unlock()
+
+	saved := make(map[string]*savedItem)
+	var touched []string
+	expires := t.expiry(DefaultExpiration)
+	for i, op := range ops {
+		if _, seen := saved[op.Key]; !seen {
+			saved[op.Key] = t.save(op.Key)
+			touched = append(touched, op.Key)
+		}
+		if op.Delete {
+			if _, exists := t.store.item(op.Key); exists {
+				t.removeItem(op.Key)
+			}
+			continue
+		}
+		values, err := indexValues(t.indexers, op.Obj)
+		if err != nil {
+			t.restore(touched, saved)
+			return err
+		}
+		t.putItem(op.Key, op.Obj, refers[i], unresolved[i], values)
+		t.store.edit(op.Key).expires = expires
+	}
+	if err := t.checkCommitted(touched, saved); err != nil {
+		t.restore(touched, saved)
+		return err
+	}
+	collectable, err := t.blockingOrder(t.deletedKeys(touched, saved))
+	if err != nil {
+		t.restore(touched, saved)
+		return err
+	}
+
+	var events []Event
+	for _, key := range touched {
+		prior := saved[key]
+		obj, exists := t.store.item(key)
+		switch {
+		case exists && prior.exists:
+			events = append(events, Event{Type: Updated, Key: key, Object: obj, OldObject: prior.obj})
+		case exists:
+			events = append(events, Event{Type: Added, Key: key, Object: obj})
+		case prior.exists:
+			events = append(events, Event{Type: Deleted, Key: key, Object: prior.obj})
+		}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	if err := t.log(walRecord{op: walCommit, ops: committedOps(events), expires: expires}); err != nil {
+		t.restore(touched, saved)
+		return err
+	}
+	version := t.broadcaster.publish(Event{Type: Committed, Events: events})
+	for _, event := range events {
+		if event.Type != Deleted {
+			t.store.edit(event.Key).version = version
+		}
+		if event.Type == Added && saved[event.Key].dangling {
+			t.resolveDangling(event.Key)
+		}
+		t.notifyReferrers(event.Key, event.Type)
+	}
+	// the blocking dependents are collected once their owners are deleted
+	if err := t.collectItems(collectable); err != nil {
+		return err
+	}
+	t.evict(touched...)
+	return nil
+}
+
+// save records the state of key before a transaction touches it.
+func (t *threadSafeMap) save(key string) *savedItem {
+	prior := new(savedItem)
+	relat := t.store.relation(key)
+	prior.obj, prior.exists = t.store.item(key)
+	if !prior.exists {
+		prior.dangling = relat != nil
+		return prior
+	}
+	prior.refers = relat.referList()
+	prior.unresolved = relat.unresolved
+	prior.indexed = relat.indexed
+	prior.version = relat.version
+	prior.expires = relat.expires
+	prior.collectable = relat.collectable
+	return prior
+}
+
+// restore puts the touched keys back in their saved state.
+func (t *threadSafeMap) restore(touched []string, saved map[string]*savedItem) {
+	for i := len(touched) - 1; i >= 0; i-- {
+		key := touched[i]
+		prior := saved[key]
+		if prior.exists {
+			t.putItem(key, prior.obj, prior.refers, prior.unresolved, prior.indexed)
+			relat := t.store.edit(key)
+			relat.version = prior.version
+			relat.expires = prior.expires
+			relat.collectable = prior.collectable
+		} else if _, exists := t.store.item(key); exists {
+			t.removeItem(key)
+		}
+	}
+}
+
+// deletedKeys lists the touched keys a transaction deleted.
+func (t *threadSafeMap) deletedKeys(touched []string, saved map[string]*savedItem) []string {
+	var deleted []string
+	for _, key := range touched {
+		if _, exists := t.store.item(key); !exists && saved[key].exists {
+			deleted = append(deleted, key)
+		}
+	}
+	return deleted
+}
+
+// checkCommitted checks the constraints on the keys touched by a transaction
+// once all of its mutations are applied.
+func (t *threadSafeMap) checkCommitted(touched []string, saved map[string]*savedItem) error {
+	for _, key := range touched {
+		if _, exists := t.store.item(key); !exists {
+			if !saved[key].exists {
+				continue
+			}
+			if referrers := t.strongReferrers(key); len(referrers) > 0 {
+				return ReferencedError{Key: key, Referrers: referrers}
+			}
+			continue
+		}
+		if t.options.rejectCycles {
+			if cycle := t.cycleThrough(key, t.store.relation(key).referList()); cycle != nil {
+				return CycleError{Cycle: cycle}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transactions", func() {
+	It("Commit mutations at once", func() {
+		c := NewCache(ObjectKey, ObjectRefers)
+		Expect(c.Add(newObject("old"))).ShouldNot(HaveOccurred())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events, err := c.Watch(ctx, nil)
+		Expect(err).ShouldNot(HaveOccurred())
+
+		txn := c.Begin()
+		Expect(txn.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+		Expect(txn.Add(newObject("b"))).ShouldNot(HaveOccurred())
+		Expect(txn.Delete(newObject("old"))).ShouldNot(HaveOccurred())
+		_, exists, _ := c.GetByKey("a")
+		Expect(exists).Should(BeFalse())
+		Expect(txn.Commit()).ShouldNot(HaveOccurred())
+
+		Expect(c.ListKeys()).Should(ConsistOf("a", "b"))
+		Expect(c.ReferencedKeys("b")).Should(Equal([]string{"a"}))
+		Expect(c.DanglingKeys()).Should(BeEmpty())
+		Expect(<-events).Should(Equal(Event{Type: Committed, Version: 2, Events: []Event{
+			{Type: Added, Key: "a", Object: newObject("a", "b"), Version: 2},
+			{Type: Added, Key: "b", Object: newObject("b"), Version: 2},
+			{Type: Deleted, Key: "old", Object: newObject("old"), Version: 2},
+		}}))
+		_, version, _, _ := c.GetByKeyWithVersion("a")
+		Expect(version).Should(Equal(uint64(2)))
+
+		Expect(txn.Add(newObject("c"))).Should(Equal(ErrTxnClosed))
+		Expect(txn.Commit()).Should(Equal(ErrTxnClosed))
+	})
+
+	It("Check constraints on the result", func() {
+		c := NewCache(ObjectKey, ObjectRefers, WithStrongReferences())
+		Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+
+		txn := c.Begin()
+		Expect(txn.Delete(newObject("b"))).ShouldNot(HaveOccurred())
+		Expect(txn.Delete(newObject("a"))).ShouldNot(HaveOccurred())
+		Expect(txn.Commit()).ShouldNot(HaveOccurred())
+		Expect(c.List()).Should(BeEmpty())
+	})
+
+	It("Leave the store unchanged on failure", func() {
+		c := NewCache(ObjectKey, ObjectRefers, WithStrongReferences())
+		Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+		_, version := c.ListWithVersion()
+
+		txn := c.Begin()
+		Expect(txn.Update(newObject("a", "c"))).ShouldNot(HaveOccurred())
+		Expect(txn.Add(newObject("c"))).ShouldNot(HaveOccurred())
+		Expect(txn.Update(newObject("a", "b"))).ShouldNot(HaveOccurred())
+		Expect(txn.Delete(newObject("b"))).ShouldNot(HaveOccurred())
+		Expect(txn.Commit()).Should(Equal(ReferencedError{Key: "b", Referrers: []string{"a"}}))
+
+		Expect(c.ListKeys()).Should(ConsistOf("a", "b"))
+		Expect(c.ReferKeys("a")).Should(Equal([]string{"b"}))
+		Expect(c.ReferencedKeys("b")).Should(Equal([]string{"a"}))
+		Expect(c.DanglingKeys()).Should(BeEmpty())
+		_, current := c.ListWithVersion()
+		Expect(current).Should(Equal(version))
+		_, objVersion, _, _ := c.GetByKeyWithVersion("a")
+		Expect(objVersion).Should(Equal(uint64(1)))
+	})
+
+	It("Reject cycles of the result", func() {
+		c := NewCache(ObjectKey, ObjectRefers, WithCycleRejection())
+		Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+
+		txn := c.Begin()
+		Expect(txn.Add(newObject("b", "a"))).ShouldNot(HaveOccurred())
+		Expect(txn.Commit()).Should(Equal(CycleError{Cycle: []string{"b", "a", "b"}}))
+		Expect(c.ListKeys()).Should(Equal([]string{"a"}))
+		Expect(c.DanglingKeys()).Should(Equal([]string{"b"}))
+
+		txn = c.Begin()
+		Expect(txn.Add(newObject("b", "a"))).ShouldNot(HaveOccurred())
+		Expect(txn.Update(newObject("a"))).ShouldNot(HaveOccurred())
+		Expect(txn.Commit()).ShouldNot(HaveOccurred())
+		Expect(c.FindCycles()).Should(BeEmpty())
+	})
+
+	It("Roll back", func() {
+		c := NewCache(ObjectKey, ObjectRefers)
+		txn := c.Begin()
+		Expect(txn.Add(newObject("a"))).ShouldNot(HaveOccurred())
+		txn.Rollback()
+		Expect(txn.Commit()).Should(Equal(ErrTxnClosed))
+		Expect(c.List()).Should(BeEmpty())
+	})
+})
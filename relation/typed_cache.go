@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import "fmt"
+
+// KeyFuncOf knows how to make a key from an object of type T. Implementations
+// should be deterministic.
+type KeyFuncOf[T any] func(obj T) (string, error)
+
+// ReferFuncOf knows how to get refers from an object of type T. Implementations
+// should be deterministic.
+type ReferFuncOf[T any] func(obj T) ([]string, error)
+
+// TypedCache is a Cache holding objects of type T only, objects are given and
+// returned as T so no type assertion is needed.
+type TypedCache[T any] interface {
+	Add(obj T) error
+	Update(obj T) error
+	Delete(obj T) error
+	List() []T
+	ListKeys() []string
+	Get(obj T) (item T, exists bool, err error)
+	GetByKey(key string) (item T, exists bool, err error)
+	Replace(list []T) error
+	Referenced(obj T) ([]T, error)
+	ReferencedKeys(key string) ([]string, error)
+	ReferKeys(key string) ([]string, error)
+	// Untyped gives the Cache behind, for the operations TypedCache doesn't
+	// wrap. Only objects of type T should be added through it.
+	Untyped() Cache
+}
+
+type typedCache[T any] struct {
+	cache Cache
+}
+
+var _ TypedCache[struct{}] = &typedCache[struct{}]{}
+
+// NewTypedCache returns a TypedCache backed by a Cache built with opts.
+func NewTypedCache[T any](keyFunc KeyFuncOf[T], referFunc ReferFuncOf[T], opts ...Option) TypedCache[T] {
+	untypedKeyFunc := func(obj interface{}) (string, error) {
+		o, ok := obj.(T)
+		if !ok {
+			return "", unexpectedType[T](obj)
+		}
+		return keyFunc(o)
+	}
+	untypedReferFunc := func(obj interface{}) ([]string, error) {
+		o, ok := obj.(T)
+		if !ok {
+			return nil, unexpectedType[T](obj)
+		}
+		return referFunc(o)
+	}
+	return &typedCache[T]{cache: NewCache(untypedKeyFunc, untypedReferFunc, opts...)}
+}
+
+func unexpectedType[T any](obj interface{}) error {
+	var expected T
+	return fmt.Errorf("expected object of type %T, got %T", expected, obj)
+}
+
+func (c *typedCache[T]) Add(obj T) error {
+	return c.cache.Add(obj)
+}
+
+func (c *typedCache[T]) Update(obj T) error {
+	return c.cache.Update(obj)
+}
+
+func (c *typedCache[T]) Delete(obj T) error {
+	return c.cache.Delete(obj)
+}
+
+func (c *typedCache[T]) List() []T {
+	return typedList[T](c.cache.List())
+}
+
+func (c *typedCache[T]) ListKeys() []string {
+	return c.cache.ListKeys()
+}
+
+func (c *typedCache[T]) Get(obj T) (item T, exists bool, err error) {
+	return typedItem[T](c.cache.Get(obj))
+}
+
+func (c *typedCache[T]) GetByKey(key string) (item T, exists bool, err error) {
+	return typedItem[T](c.cache.GetByKey(key))
+}
+
+func (c *typedCache[T]) Replace(list []T) error {
+	untyped := make([]interface{}, 0, len(list))
+	for _, obj := range list {
+		untyped = append(untyped, obj)
+	}
+	return c.cache.Replace(untyped)
+}
+
+func (c *typedCache[T]) Referenced(obj T) ([]T, error) {
+	list, err := c.cache.Referenced(obj)
+	if err != nil {
+		return nil, err
+	}
+	return typedList[T](list), nil
+}
+
+func (c *typedCache[T]) ReferencedKeys(key string) ([]string, error) {
+	return c.cache.ReferencedKeys(key)
+}
+
+func (c *typedCache[T]) ReferKeys(key string) ([]string, error) {
+	return c.cache.ReferKeys(key)
+}
+
+func (c *typedCache[T]) Untyped() Cache {
+	return c.cache
+}
+
+func typedItem[T any](item interface{}, exists bool, err error) (T, bool, error) {
+	var typed T
+	if item != nil {
+		typed = item.(T)
+	}
+	return typed, exists, err
+}
+
+func typedList[T any](list []interface{}) []T {
+	if list == nil {
+		return nil
+	}
+	typed := make([]T, 0, len(list))
+	for _, item := range list {
+		typed = append(typed, item.(T))
+	}
+	return typed
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Typed cache", func() {
+	keyFunc := func(o *Object) (string, error) {
+		return o.ID, nil
+	}
+	referFunc := func(o *Object) ([]string, error) {
+		return ObjectRefers(o)
+	}
+	subObj1 := &Object{ID: "sub_object1"}
+	obj1 := &Object{ID: "object1", SubObjects: []*Object{subObj1}}
+
+	It("Store typed objects", func() {
+		c := NewTypedCache(keyFunc, referFunc)
+		Expect(c.Add(obj1)).ShouldNot(HaveOccurred())
+		Expect(c.Add(subObj1)).ShouldNot(HaveOccurred())
+
+		item, exists, err := c.Get(subObj1)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(exists).Should(BeTrue())
+		Expect(item.ID).Should(Equal(subObj1.ID))
+		item, exists, err = c.GetByKey("missing")
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(exists).Should(BeFalse())
+		Expect(item).Should(BeNil())
+
+		referenced, err := c.Referenced(subObj1)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(referenced).Should(Equal([]*Object{obj1}))
+		Expect(c.List()).Should(ConsistOf(obj1, subObj1))
+
+		Expect(c.Replace([]*Object{subObj1})).ShouldNot(HaveOccurred())
+		Expect(c.ListKeys()).Should(Equal([]string{subObj1.ID}))
+		Expect(c.Delete(subObj1)).ShouldNot(HaveOccurred())
+		Expect(c.List()).Should(BeEmpty())
+	})
+
+	It("Reject other types through the untyped cache", func() {
+		c := NewTypedCache(keyFunc, referFunc)
+		Expect(c.Untyped().Add("object")).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,847 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/firemiles/go-cache/pkg/types"
+)
+
+// ErrClosed is returned by the writes of a DurableCache once it is closed.
+var ErrClosed = errors.New("durable cache is closed")
+
+// SyncPolicy decides when a DurableCache flushes its write-ahead log to disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes the log before a mutation returns, nothing is lost
+	// on a crash.
+	SyncAlways SyncPolicy = iota
+	// SyncPeriodically flushes the log in the background, see
+	// WithSyncInterval. The mutations of the last interval may be lost on a
+	// crash.
+	SyncPeriodically
+	// SyncNever leaves flushing to the operating system, the log is flushed
+	// by Sync and Close only.
+	SyncNever
+)
+
+// DurableCache is a Cache whose mutations are appended to a write-ahead log on
+// disk, the contents are restored by opening it again.
+type DurableCache interface {
+	Cache
+	// Sync flushes the log to disk.
+	Sync() error
+	// Compact saves the contents as a snapshot and starts an empty log, so
+	// opening the cache doesn't replay the mutations made so far.
+	Compact() error
+	// Close flushes and closes the log, later writes return ErrClosed.
+	Close() error
+}
+
+// OpenDurableCache opens the cache stored in dir, which is created if needed.
+// The last snapshot saved by Compact is loaded, then the mutations logged
+// since are replayed, a record torn by a crash at the end of the log is
+// dropped. Objects are encoded with the codec set by WithCodec, gob by default,
+// the log is flushed according to WithSyncPolicy. The objects replayed from the
+// log expire when they were to, a snapshot keeps no TTL so the objects loaded
+// from it expire after the default TTL.
+func OpenDurableCache(dir string, keyFunc types.KeyFunc, referFunc ReferFunc, opts ...Option) (DurableCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	o := newOptions(opts)
+	w := &writeAheadLog{dir: dir, codec: o.codec, policy: o.syncPolicy}
+	if w.codec == nil {
+		w.codec = NewGobCodec()
+	}
+	opts = append(opts, WithCodec(w.codec), func(o *options) {
+		o.wal = w
+	})
+	c := NewCache(keyFunc, referFunc, opts...).(*cache)
+	c.cacheStorage = &walStore{RelationStore: c.cacheStorage, wal: w}
+	if err := w.open(c); err != nil {
+		w.close()
+		return nil, err
+	}
+	if w.policy == SyncPeriodically {
+		if o.syncInterval <= 0 {
+			o.syncInterval = defaultSyncInterval
+		}
+		w.stop = make(chan struct{})
+		w.stopped = make(chan struct{})
+		go w.syncEvery(o.syncInterval)
+	}
+	return &durableCache{cache: c, wal: w}, nil
+}
+
+type durableCache struct {
+	*cache
+	wal *writeAheadLog
+	// compactLock serializes the compactions.
+	compactLock sync.Mutex
+}
+
+var _ DurableCache = &durableCache{}
+
+func (d *durableCache) Sync() error {
+	return d.wal.sync()
+}
+
+// Compact starts the log of the next generation before saving the snapshot,
+// the mutations made meanwhile are in both and replaying them again on the
+// snapshot leaves it unchanged.
+func (d *durableCache) Compact() error {
+	d.compactLock.Lock()
+	defer d.compactLock.Unlock()
+
+	gen, err := d.wal.rotate()
+	if err != nil {
+		return err
+	}
+	path := d.wal.path(snapshotFile, gen)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = d.SaveSnapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if err := syncDir(d.wal.dir); err != nil {
+		return err
+	}
+	return d.wal.removeBefore(gen)
+}
+
+// Close also stops the janitor.
+func (d *durableCache) Close() error {
+	d.Stop()
+	return d.wal.close()
+}
+
+// walStore rejects the writes once the log failed, the log is written by the
+// store it wraps, under its lock, before each mutation is applied.
+type walStore struct {
+	RelationStore
+	wal *writeAheadLog
+}
+
+// check runs write if the log is healthy, and reports the log failing while
+// write was logged.
+func (s *walStore) check(write func() error) error {
+	if err := s.wal.failed(); err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	return s.wal.failed()
+}
+
+func (s *walStore) Add(key string, obj interface{}) error {
+	return s.check(func() error { return s.RelationStore.Add(key, obj) })
+}
+
+func (s *walStore) Update(key string, obj interface{}) error {
+	return s.check(func() error { return s.RelationStore.Update(key, obj) })
+}
+
+func (s *walStore) UpdateWithTTL(key string, obj interface{}, ttl time.Duration) error {
+	return s.check(func() error { return s.RelationStore.UpdateWithTTL(key, obj, ttl) })
+}
+
+func (s *walStore) UpdateIfVersion(key string, obj interface{}, expectedVersion uint64) error {
+	return s.check(func() error { return s.RelationStore.UpdateIfVersion(key, obj, expectedVersion) })
+}
+
+func (s *walStore) Delete(key string) error {
+	return s.check(func() error { return s.RelationStore.Delete(key) })
+}
+
+func (s *walStore) Replace(items map[string]interface{}) (delta ReplaceDelta, err error) {
+	err = s.check(func() error {
+		delta, err = s.RelationStore.Replace(items)
+		return err
+	})
+	return delta, err
+}
+
+func (s *walStore) Commit(ops []TxnOp) error {
+	return s.check(func() error { return s.RelationStore.Commit(ops) })
+}
+
+func (s *walStore) DeleteCascade(key string, propagation DeletionPropagation) (deleted []string, err error) {
+	err = s.check(func() error {
+		deleted, err = s.RelationStore.DeleteCascade(key, propagation)
+		return err
+	})
+	return deleted, err
+}
+
+type walOp byte
+
+const (
+	walPut walOp = iota + 1
+	walDelete
+	walReplace
+	walCommit
+)
+
+// walRecord is a mutation of a store, it holds the resulting objects so
+// replaying it again leaves the store unchanged.
+type walRecord struct {
+	op    walOp
+	key   string
+	obj   interface{}
+	items map[string]interface{}
+	ops   []TxnOp
+	// expires is the time in nanoseconds the objects put expire at, 0 if
+	// never. A replace keeps the expiry time of the objects it leaves
+	// unchanged.
+	expires int64
+}
+
+// committedOps turns the events of a transaction into the ops leading to its
+// result.
+func committedOps(events []Event) []TxnOp {
+	ops := make([]TxnOp, 0, len(events))
+	for _, event := range events {
+		if event.Type == Deleted {
+			ops = append(ops, TxnOp{Key: event.Key, Delete: true})
+		} else {
+			ops = append(ops, TxnOp{Key: event.Key, Obj: event.Object})
+		}
+	}
+	return ops
+}
+
+// file names of the log and of the snapshots, suffixed by their generation.
+const (
+	walFile      = "wal"
+	snapshotFile = "snapshot"
+
+	walMagic  = "gocache-wal\x00"
+	walFormat = 2
+)
+
+// writeAheadLog appends the mutations of a store to a file, one record per
+// mutation. A record is framed by the length and the CRC-32 of its payload, in
+// big endian. Compacting the log saves the snapshot of the next generation,
+// which replaces the logs of the previous ones.
+type writeAheadLog struct {
+	dir    string
+	codec  Codec
+	policy SyncPolicy
+
+	lock sync.Mutex
+	gen  uint64
+	// file is nil until the log is replayed, records are dropped until then.
+	file *os.File
+	// err is the first failure of the log, which then rejects the writes.
+	err error
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func (w *writeAheadLog) path(name string, gen uint64) string {
+	return filepath.Join(w.dir, name+"."+strconv.FormatUint(gen, 10))
+}
+
+// generations lists the generations of the snapshots and logs in dir, in
+// order.
+func (w *writeAheadLog) generations() (snapshots, logs []uint64, err error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		name, suffix, found := strings.Cut(entry.Name(), ".")
+		if !found {
+			continue
+		}
+		gen, err := strconv.ParseUint(suffix, 10, 64)
+		if err != nil {
+			continue
+		}
+		switch name {
+		case snapshotFile:
+			snapshots = append(snapshots, gen)
+		case walFile:
+			logs = append(logs, gen)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i] < snapshots[j] })
+	sort.Slice(logs, func(i, j int) bool { return logs[i] < logs[j] })
+	return snapshots, logs, nil
+}
+
+// open loads the last snapshot into c and replays the logs since, then opens
+// the last log for appending.
+func (w *writeAheadLog) open(c *cache) error {
+	snapshots, logs, err := w.generations()
+	if err != nil {
+		return err
+	}
+	var gen uint64
+	if len(snapshots) > 0 {
+		gen = snapshots[len(snapshots)-1]
+		if err := w.load(c, gen); err != nil {
+			return err
+		}
+	}
+	last := gen
+	for _, logGen := range logs {
+		if logGen < gen {
+			continue
+		}
+		if err := w.replay(c.cacheStorage.(*walStore).RelationStore.(expiryStore), logGen); err != nil {
+			return err
+		}
+		last = logGen
+	}
+	f, err := w.openFile(last)
+	if err != nil {
+		return err
+	}
+	w.lock.Lock()
+	w.gen, w.file = last, f
+	w.lock.Unlock()
+	return w.removeBefore(gen)
+}
+
+func (w *writeAheadLog) load(c *cache, gen uint64) error {
+	f, err := os.Open(w.path(snapshotFile, gen))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.LoadSnapshot(bufio.NewReader(f))
+}
+
+// expiryStore is a store whose expiry times can be restored.
+type expiryStore interface {
+	RelationStore
+	restoreExpiry(expires map[string]int64)
+}
+
+// replay applies the records of the log of gen to store. Puts and deletes are
+// committed together, the store only has to be valid at the end of the log or
+// before a replace. A torn record ends the log, it is truncated there. The
+// expiry times are restored once all the records are applied.
+func (w *writeAheadLog) replay(store expiryStore, gen uint64) error {
+	path := w.path(walFile, gen)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+
+	offset, err := w.readHeader(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// the log was created but its header not written
+			return os.Truncate(path, 0)
+		}
+		return err
+	}
+	var ops []TxnOp
+	expires := make(map[string]int64)
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		err := store.Commit(ops)
+		ops = nil
+		return err
+	}
+	for {
+		payload, err := readRecord(r, info.Size()-offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err := os.Truncate(path, offset); err != nil {
+				return err
+			}
+			break
+		}
+		offset += int64(recordHeaderSize + len(payload))
+
+		rec, err := w.decode(payload)
+		if err != nil {
+			return fmt.Errorf("replaying %s: %v", path, err)
+		}
+		switch rec.op {
+		case walPut:
+			ops = append(ops, TxnOp{Key: rec.key, Obj: rec.obj})
+			expires[rec.key] = rec.expires
+		case walDelete:
+			ops = append(ops, TxnOp{Key: rec.key, Delete: true})
+			delete(expires, rec.key)
+		case walCommit:
+			ops = append(ops, rec.ops...)
+			for _, op := range rec.ops {
+				if op.Delete {
+					delete(expires, op.Key)
+				} else {
+					expires[op.Key] = rec.expires
+				}
+			}
+		case walReplace:
+			if err := flush(); err != nil {
+				return err
+			}
+			delta, err := store.Replace(rec.items)
+			if err != nil {
+				return err
+			}
+			// the unchanged objects keep their expiry time
+			kept := make(map[string]int64, len(rec.items))
+			for key := range rec.items {
+				if at, logged := expires[key]; logged {
+					kept[key] = at
+				}
+			}
+			for _, key := range append(delta.Added, delta.Changed...) {
+				kept[key] = rec.expires
+			}
+			expires = kept
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	store.restoreExpiry(expires)
+	return nil
+}
+
+// readHeader checks the header of a log and returns its size.
+func (w *writeAheadLog) readHeader(r io.Reader) (int64, error) {
+	magic := make([]byte, len(walMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return 0, err
+	}
+	if string(magic) != walMagic {
+		return 0, errors.New("not a write-ahead log")
+	}
+	var format uint16
+	if err := binary.Read(r, binary.BigEndian, &format); err != nil {
+		return 0, err
+	}
+	if format != walFormat {
+		return 0, fmt.Errorf("unsupported write-ahead log format version %d", format)
+	}
+	var codecLen uint8
+	if err := binary.Read(r, binary.BigEndian, &codecLen); err != nil {
+		return 0, err
+	}
+	codec := make([]byte, codecLen)
+	if _, err := io.ReadFull(r, codec); err != nil {
+		return 0, err
+	}
+	if string(codec) != w.codec.Name() {
+		return 0, fmt.Errorf("write-ahead log encoded with codec %q instead of %q", codec, w.codec.Name())
+	}
+	return int64(len(walMagic) + 2 + 1 + len(codec)), nil
+}
+
+// recordHeaderSize is the size of the length and the checksum of a record.
+const recordHeaderSize = 8
+
+// readRecord reads the payload of the next record, which has left bytes of the
+// log to fit in. io.EOF tells the log ends before it and any other error that
+// the record is torn, a torn length isn't trusted beyond the end of the log.
+func readRecord(r io.Reader, left int64) ([]byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[:4]))
+	if size > left-recordHeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+// openFile opens the log of gen for appending, writing its header if it is
+// new.
+func (w *writeAheadLog) openFile(gen uint64) (*os.File, error) {
+	f, err := os.OpenFile(w.path(walFile, gen), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.Size() == 0 {
+		var buf bytes.Buffer
+		buf.WriteString(walMagic)
+		binary.Write(&buf, binary.BigEndian, uint16(walFormat))
+		buf.WriteByte(byte(len(w.codec.Name())))
+		buf.WriteString(w.codec.Name())
+		if _, err = f.Write(buf.Bytes()); err == nil {
+			err = f.Sync()
+		}
+		if err == nil {
+			err = syncDir(w.dir)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// append logs rec before the mutation is applied, which must not be if the
+// log failed. The caller holds the lock of the keys rec mutates so the records
+// of a key are in the order of its mutations.
+func (w *writeAheadLog) append(rec walRecord) error {
+	payload, encodeErr := w.encode(rec)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if w.file == nil {
+		// replaying
+		return nil
+	}
+	if encodeErr != nil {
+		w.err = encodeErr
+		return w.err
+	}
+	frame := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload))
+	frame = append(frame, payload...)
+	if _, err := w.file.Write(frame); err != nil {
+		w.err = err
+		return w.err
+	}
+	if w.policy == SyncAlways {
+		if err := w.file.Sync(); err != nil {
+			w.err = err
+		}
+	}
+	return w.err
+}
+
+func (w *writeAheadLog) encode(rec walRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(rec.op))
+	if rec.op != walDelete {
+		writeUvarint(&buf, uint64(rec.expires))
+	}
+	switch rec.op {
+	case walPut:
+		writeString(&buf, rec.key)
+		if err := w.writeObject(&buf, rec.obj); err != nil {
+			return nil, err
+		}
+	case walDelete:
+		writeString(&buf, rec.key)
+	case walReplace:
+		writeUvarint(&buf, uint64(len(rec.items)))
+		for key, obj := range rec.items {
+			writeString(&buf, key)
+			if err := w.writeObject(&buf, obj); err != nil {
+				return nil, err
+			}
+		}
+	case walCommit:
+		writeUvarint(&buf, uint64(len(rec.ops)))
+		for _, op := range rec.ops {
+			if op.Delete {
+				buf.WriteByte(1)
+				writeString(&buf, op.Key)
+				continue
+			}
+			buf.WriteByte(0)
+			writeString(&buf, op.Key)
+			if err := w.writeObject(&buf, op.Obj); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (w *writeAheadLog) decode(payload []byte) (walRecord, error) {
+	r := bytes.NewReader(payload)
+	op, err := r.ReadByte()
+	if err != nil {
+		return walRecord{}, err
+	}
+	rec := walRecord{op: walOp(op)}
+	if rec.op != walDelete {
+		expires, err := binary.ReadUvarint(r)
+		if err != nil {
+			return rec, err
+		}
+		rec.expires = int64(expires)
+	}
+	switch rec.op {
+	case walPut:
+		if rec.key, err = readString(r); err != nil {
+			return rec, err
+		}
+		rec.obj, err = w.readObject(r)
+	case walDelete:
+		rec.key, err = readString(r)
+	case walReplace:
+		var n uint64
+		if n, err = binary.ReadUvarint(r); err != nil {
+			return rec, err
+		}
+		rec.items = make(map[string]interface{})
+		for i := uint64(0); i < n; i++ {
+			key, err := readString(r)
+			if err != nil {
+				return rec, err
+			}
+			if rec.items[key], err = w.readObject(r); err != nil {
+				return rec, err
+			}
+		}
+	case walCommit:
+		var n uint64
+		if n, err = binary.ReadUvarint(r); err != nil {
+			return rec, err
+		}
+		for i := uint64(0); i < n; i++ {
+			del, err := r.ReadByte()
+			if err != nil {
+				return rec, err
+			}
+			op := TxnOp{Delete: del == 1}
+			if op.Key, err = readString(r); err != nil {
+				return rec, err
+			}
+			if !op.Delete {
+				if op.Obj, err = w.readObject(r); err != nil {
+					return rec, err
+				}
+			}
+			rec.ops = append(rec.ops, op)
+		}
+	default:
+		err = fmt.Errorf("unknown record type %d", op)
+	}
+	return rec, err
+}
+
+// writeObject encodes obj on its own, prefixed by its length.
+func (w *writeAheadLog) writeObject(buf *bytes.Buffer, obj interface{}) error {
+	var encoded bytes.Buffer
+	if err := w.codec.NewEncoder(&encoded).Encode(obj); err != nil {
+		return err
+	}
+	writeUvarint(buf, uint64(encoded.Len()))
+	buf.Write(encoded.Bytes())
+	return nil
+}
+
+func (w *writeAheadLog) readObject(r *bytes.Reader) (interface{}, error) {
+	encoded, err := readBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	return w.codec.NewDecoder(bytes.NewReader(encoded)).Decode()
+}
+
+func writeUvarint(buf *bytes.Buffer, n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], n)])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	b, err := readBytes(r)
+	return string(b), err
+}
+
+// rotate switches to the log of the next generation and returns it.
+func (w *writeAheadLog) rotate() (uint64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	f, err := w.openFile(w.gen + 1)
+	if err != nil {
+		return 0, err
+	}
+	if err := w.file.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	w.file.Close()
+	w.file = f
+	w.gen++
+	return w.gen, nil
+}
+
+// removeBefore removes the snapshots and logs older than gen.
+func (w *writeAheadLog) removeBefore(gen uint64) error {
+	snapshots, logs, err := w.generations()
+	if err != nil {
+		return err
+	}
+	for _, g := range snapshots {
+		if g < gen {
+			if err := os.Remove(w.path(snapshotFile, g)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, g := range logs {
+		if g < gen {
+			if err := os.Remove(w.path(walFile, g)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// failed returns the failure of the log, ErrClosed once closed.
+func (w *writeAheadLog) failed() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.err
+}
+
+func (w *writeAheadLog) sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.file.Sync(); err != nil {
+		w.err = err
+	}
+	return w.err
+}
+
+func (w *writeAheadLog) syncEvery(interval time.Duration) {
+	defer close(w.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.sync()
+		}
+	}
+}
+
+func (w *writeAheadLog) close() error {
+	w.stopOnce.Do(func() {
+		if w.stop != nil {
+			close(w.stop)
+			<-w.stopped
+		}
+	})
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return ErrClosed
+	}
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	w.err = ErrClosed
+	return err
+}
+
+// syncDir flushes the entries of dir, so created and renamed files persist.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
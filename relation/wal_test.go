@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Write-ahead log", func() {
+	var dir string
+	open := func(opts ...Option) DurableCache {
+		c, err := OpenDurableCache(dir, ObjectKey, ObjectRefers, opts...)
+		Expect(err).ShouldNot(HaveOccurred())
+		return c
+	}
+	files := func() []string {
+		entries, err := os.ReadDir(dir)
+		Expect(err).ShouldNot(HaveOccurred())
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	BeforeEach(func() {
+		gob.Register(&Object{})
+		var err error
+		dir, err = os.MkdirTemp("", "wal")
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Replay the mutations", func() {
+		c := open()
+		Expect(c.Replace([]interface{}{newObject("a", "b"), newObject("b"), newObject("old")})).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("c", "a"))).ShouldNot(HaveOccurred())
+		Expect(c.Update(newObject("a", "b", "d"))).ShouldNot(HaveOccurred())
+		Expect(c.Delete(newObject("old"))).ShouldNot(HaveOccurred())
+		Expect(c.UpdateIfVersion(newObject("b", "x"), 99)).Should(BeAssignableToTypeOf(ConflictError{}))
+		txn := c.Begin()
+		Expect(txn.Add(newObject("e", "c"))).ShouldNot(HaveOccurred())
+		Expect(txn.Add(newObject("f"))).ShouldNot(HaveOccurred())
+		Expect(txn.Commit()).ShouldNot(HaveOccurred())
+		Expect(c.DeleteCascade(newObject("f"), DeletePropagationForeground)).Should(Equal([]string{"f"}))
+		Expect(c.Close()).ShouldNot(HaveOccurred())
+
+		c = open()
+		defer c.Close()
+		Expect(c.ListKeys()).Should(ConsistOf("a", "b", "c", "e"))
+		Expect(c.ReferKeys("a")).Should(ConsistOf("b", "d"))
+		Expect(c.ReferencedKeys("a")).Should(Equal([]string{"c"}))
+		Expect(c.ReferencedKeys("c")).Should(Equal([]string{"e"}))
+		Expect(c.DanglingKeys()).Should(Equal([]string{"d"}))
+	})
+
+	It("Compact the log into a snapshot", func() {
+		c := open(WithSyncPolicy(SyncNever))
+		Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+		Expect(c.Compact()).ShouldNot(HaveOccurred())
+		Expect(files()).Should(ConsistOf("snapshot.1", "wal.1"))
+		Expect(c.Delete(newObject("a"))).ShouldNot(HaveOccurred())
+		Expect(c.Compact()).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("c", "b"))).ShouldNot(HaveOccurred())
+		Expect(c.Close()).ShouldNot(HaveOccurred())
+		Expect(files()).Should(ConsistOf("snapshot.2", "wal.2"))
+
+		c = open()
+		defer c.Close()
+		Expect(c.ListKeys()).Should(ConsistOf("b", "c"))
+		Expect(c.ReferencedKeys("b")).Should(Equal([]string{"c"}))
+	})
+
+	It("Replay the log left by an interrupted compaction", func() {
+		c := open()
+		Expect(c.Add(newObject("a", "b"))).ShouldNot(HaveOccurred())
+		Expect(c.Compact()).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b"))).ShouldNot(HaveOccurred())
+		Expect(c.Close()).ShouldNot(HaveOccurred())
+		// a compaction started the next log but died before its snapshot
+		f, err := os.Create(filepath.Join(dir, "wal.2"))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(f.Close()).ShouldNot(HaveOccurred())
+
+		c = open()
+		Expect(c.Add(newObject("c"))).ShouldNot(HaveOccurred())
+		Expect(c.Close()).ShouldNot(HaveOccurred())
+		c = open()
+		defer c.Close()
+		Expect(c.ListKeys()).Should(ConsistOf("a", "b", "c"))
+	})
+
+	It("Drop a torn record", func() {
+		c := open(WithSyncPolicy(SyncPeriodically), WithSyncInterval(time.Millisecond))
+		Expect(c.Add(newObject("a"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b", "a"))).ShouldNot(HaveOccurred())
+		Expect(c.Close()).ShouldNot(HaveOccurred())
+		path := filepath.Join(dir, "wal.0")
+		info, err := os.Stat(path)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(os.Truncate(path, info.Size()-3)).ShouldNot(HaveOccurred())
+
+		c = open()
+		Expect(c.ListKeys()).Should(Equal([]string{"a"}))
+		Expect(c.Add(newObject("c", "a"))).ShouldNot(HaveOccurred())
+		Expect(c.Close()).ShouldNot(HaveOccurred())
+		c = open()
+		defer c.Close()
+		Expect(c.ListKeys()).Should(ConsistOf("a", "c"))
+		Expect(c.ReferencedKeys("a")).Should(Equal([]string{"c"}))
+	})
+
+	It("Drop a record whose length runs past the log", func() {
+		c := open()
+		Expect(c.Add(newObject("a"))).ShouldNot(HaveOccurred())
+		Expect(c.Close()).ShouldNot(HaveOccurred())
+		path := filepath.Join(dir, "wal.0")
+		info, err := os.Stat(path)
+		Expect(err).ShouldNot(HaveOccurred())
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		Expect(err).ShouldNot(HaveOccurred())
+		_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0, 1})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(f.Close()).ShouldNot(HaveOccurred())
+
+		c = open()
+		defer c.Close()
+		Expect(c.ListKeys()).Should(Equal([]string{"a"}))
+		truncated, err := os.Stat(path)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(truncated.Size()).Should(Equal(info.Size()))
+	})
+
+	It("Leave the store unchanged by the writes the log failed", func() {
+		c := open()
+		Expect(c.Add(newObject("a"))).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("b", "a"))).ShouldNot(HaveOccurred())
+		// writing to the closed file fails
+		Expect(c.(*durableCache).wal.file.Close()).ShouldNot(HaveOccurred())
+
+		txn := c.Begin()
+		Expect(txn.Delete(newObject("a"))).ShouldNot(HaveOccurred())
+		Expect(txn.Add(newObject("c", "b"))).ShouldNot(HaveOccurred())
+		Expect(txn.Commit()).Should(HaveOccurred())
+		Expect(c.Delete(newObject("b"))).Should(HaveOccurred())
+		Expect(c.ListKeys()).Should(ConsistOf("a", "b"))
+		Expect(c.ReferencedKeys("a")).Should(Equal([]string{"b"}))
+		c.Close()
+
+		c = open()
+		defer c.Close()
+		Expect(c.ListKeys()).Should(ConsistOf("a", "b"))
+	})
+
+	It("Restore the expiry times", func() {
+		fakeNow = time.Unix(1600000000, 0)
+		c := open(fakeClock, WithDefaultTTL(time.Hour))
+		Expect(c.AddWithTTL(newObject("a"), time.Minute)).ShouldNot(HaveOccurred())
+		Expect(c.AddWithTTL(newObject("b"), NoExpiration)).ShouldNot(HaveOccurred())
+		txn := c.Begin()
+		Expect(txn.Add(newObject("c"))).ShouldNot(HaveOccurred())
+		Expect(txn.Commit()).ShouldNot(HaveOccurred())
+		// a resync with the same objects leaves their TTLs
+		Expect(c.Replace([]interface{}{newObject("a"), newObject("b"), newObject("c")})).ShouldNot(HaveOccurred())
+		Expect(c.Close()).ShouldNot(HaveOccurred())
+
+		fakeNow = fakeNow.Add(2 * time.Minute)
+		c = open(fakeClock, WithDefaultTTL(time.Hour))
+		defer c.Close()
+		Expect(c.ListKeys()).Should(ConsistOf("b", "c"))
+		fakeNow = fakeNow.Add(time.Hour)
+		Expect(c.DeleteExpired()).Should(Equal([]string{"a", "c"}))
+		Expect(c.ListKeys()).Should(Equal([]string{"b"}))
+	})
+
+	It("Reject writes once closed", func() {
+		c := open()
+		Expect(c.Close()).ShouldNot(HaveOccurred())
+		Expect(c.Add(newObject("a"))).Should(Equal(ErrClosed))
+		Expect(c.Begin().Commit()).ShouldNot(HaveOccurred())
+		Expect(c.Sync()).Should(Equal(ErrClosed))
+		Expect(c.Close()).Should(Equal(ErrClosed))
+	})
+
+	It("Refuse a log of another codec", func() {
+		c := open()
+		Expect(c.Add(newObject("a"))).ShouldNot(HaveOccurred())
+		Expect(c.Close()).ShouldNot(HaveOccurred())
+		_, err := OpenDurableCache(dir, ObjectKey, ObjectRefers, WithCodec(NewJSONCodec(func() interface{} {
+			return &Object{}
+		})))
+		Expect(err).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,311 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// EventType is the kind of mutation an Event reports.
+type EventType string
+
+const (
+	// Added is reported when an object is stored under a new key.
+	Added EventType = "Added"
+	// Updated is reported when the object stored under a key is replaced.
+	Updated EventType = "Updated"
+	// Deleted is reported when an object is deleted.
+	Deleted EventType = "Deleted"
+	// Replaced is reported when the whole contents are replaced.
+	Replaced EventType = "Replaced"
+	// Committed is reported when a transaction is committed.
+	Committed EventType = "Committed"
+	// Expired is reported when an object is deleted because its TTL elapsed.
+	Expired EventType = "Expired"
+	// Evicted is reported when an object is deleted to keep the store within
+	// its bounds.
+	Evicted EventType = "Evicted"
+	// Collected is reported when a collectable object is deleted because
+	// nothing refers to it anymore, or an object because its owners are gone.
+	Collected EventType = "Collected"
+)
+
+// Event is a mutation of a store as seen by a watcher.
+type Event struct {
+	Type EventType
+	// Key is the key of the mutated object, it is empty for Replaced.
+	Key string
+	// Object is the object stored by Added and Updated, or the deleted,
+	// expired or evicted one.
+	Object interface{}
+	// OldObject is the object overwritten by Updated.
+	OldObject interface{}
+	// Delta lists the keys touched by Replaced.
+	Delta *ReplaceDelta
+	// Events are the Added, Updated and Deleted events grouped by Committed,
+	// one per key touched by the transaction.
+	Events []Event
+	// Version is the version of the store right after the mutation, every
+	// event increases it by one.
+	Version uint64
+}
+
+// ReferentChange tells Referrer that the object it refers to, Referent, was
+// changed by a mutation of the given type.
+type ReferentChange struct {
+	Referrer string
+	Referent string
+	Type     EventType
+}
+
+// SlowConsumerPolicy decides what happens to a watcher whose buffer is full.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerDisconnect closes the channel of the watcher, it can watch
+	// again from the last version it received.
+	SlowConsumerDisconnect SlowConsumerPolicy = iota
+	// SlowConsumerDrop drops the events the watcher has no room for.
+	SlowConsumerDrop
+	// SlowConsumerBlock blocks the writers until the watcher makes room, or
+	// its context is done.
+	SlowConsumerBlock
+)
+
+const defaultWatchBufferSize = 100
+
+// ErrVersionTooOld is returned when watching from a version older than the
+// events kept by the store.
+var ErrVersionTooOld = errors.New("version is too old to resume from")
+
+// ErrVersionInFuture is returned when watching from a version the store hasn't
+// reached yet, which it can't have given.
+var ErrVersionInFuture = errors.New("version is newer than the store")
+
+// WatchOption configures a watcher.
+type WatchOption func(*watcher)
+
+// WatchBufferSize sets the number of events buffered for the watcher, 100 by
+// default.
+func WatchBufferSize(size int) WatchOption {
+	return func(w *watcher) {
+		w.bufferSize = size
+	}
+}
+
+// WatchSlowConsumerPolicy sets what happens when the watcher doesn't keep up,
+// SlowConsumerDisconnect by default.
+func WatchSlowConsumerPolicy(policy SlowConsumerPolicy) WatchOption {
+	return func(w *watcher) {
+		w.policy = policy
+	}
+}
+
+// WatchFromVersion resumes watching after version, the events since are
+// replayed first. ErrVersionTooOld is returned if they aren't kept anymore, see
+// WithWatchHistory, and ErrVersionInFuture if version is newer than the store.
+func WatchFromVersion(version uint64) WatchOption {
+	return func(w *watcher) {
+		w.resume = true
+		w.resumeVersion = version
+	}
+}
+
+type watcher struct {
+	ctx    context.Context
+	filter func(Event) bool
+	ch     chan Event
+	// done is closed once ch is closed.
+	done chan struct{}
+
+	bufferSize    int
+	policy        SlowConsumerPolicy
+	resume        bool
+	resumeVersion uint64
+}
+
+// broadcaster numbers the events of a store, keeps the latest ones and sends
+// them to the watchers.
+type broadcaster struct {
+	lock     sync.Mutex
+	version  uint64
+	history  []Event
+	next     int
+	watchers map[*watcher]struct{}
+}
+
+func newBroadcaster(historySize int) *broadcaster {
+	return &broadcaster{
+		history:  make([]Event, 0, historySize),
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+// currentVersion gives the version of the last event.
+func (b *broadcaster) currentVersion() uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.version
+}
+
+// publish numbers events and sends them to the watchers, it returns the version
+// of the last one. The store calls it with its write lock held, so events are
+// seen in the order of the mutations.
+func (b *broadcaster) publish(events ...Event) uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, event := range events {
+		b.version++
+		event.Version = b.version
+		for i := range event.Events {
+			event.Events[i].Version = b.version
+		}
+		b.record(event)
+		for w := range b.watchers {
+			b.send(w, event)
+		}
+	}
+	return b.version
+}
+
+// record keeps event in the history ring.
+func (b *broadcaster) record(event Event) {
+	if cap(b.history) == 0 {
+		return
+	}
+	if len(b.history) < cap(b.history) {
+		b.history = append(b.history, event)
+		return
+	}
+	b.history[b.next] = event
+	b.next = (b.next + 1) % len(b.history)
+}
+
+// since lists the kept events after version, it fails if some of them aren't
+// kept anymore or if version wasn't reached yet.
+func (b *broadcaster) since(version uint64) ([]Event, error) {
+	if version > b.version {
+		return nil, ErrVersionInFuture
+	}
+	missing := int(b.version - version)
+	if missing > len(b.history) {
+		return nil, ErrVersionTooOld
+	}
+	events := make([]Event, 0, missing)
+	for i := len(b.history) - missing; i < len(b.history); i++ {
+		events = append(events, b.history[(b.next+i)%len(b.history)])
+	}
+	return events, nil
+}
+
+func (b *broadcaster) send(w *watcher, event Event) {
+	if w.filter != nil && !w.filter(event) {
+		return
+	}
+	switch w.policy {
+	case SlowConsumerBlock:
+		select {
+		case w.ch <- event:
+		case <-w.ctx.Done():
+		}
+	case SlowConsumerDrop:
+		select {
+		case w.ch <- event:
+		default:
+		}
+	default:
+		select {
+		case w.ch <- event:
+		default:
+			b.remove(w)
+		}
+	}
+}
+
+func (b *broadcaster) watch(ctx context.Context, filter func(Event) bool, opts []WatchOption) (<-chan Event, error) {
+	w := &watcher{ctx: ctx, filter: filter, done: make(chan struct{}), bufferSize: defaultWatchBufferSize}
+	for _, opt := range opts {
+		opt(w)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var replay []Event
+	if w.resume {
+		var err error
+		if replay, err = b.since(w.resumeVersion); err != nil {
+			return nil, err
+		}
+	}
+	w.ch = make(chan Event, w.bufferSize+len(replay))
+	for _, event := range replay {
+		if filter == nil || filter(event) {
+			w.ch <- event
+		}
+	}
+	b.watchers[w] = struct{}{}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-w.done:
+			return
+		}
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.remove(w)
+	}()
+	return w.ch, nil
+}
+
+// remove closes the channel of w once, b.lock must be held.
+func (b *broadcaster) remove(w *watcher) {
+	if _, exists := b.watchers[w]; !exists {
+		return
+	}
+	delete(b.watchers, w)
+	close(w.ch)
+	close(w.done)
+}
+
+func (t *threadSafeMap) Watch(ctx context.Context, filter func(Event) bool, opts ...WatchOption) (<-chan Event, error) {
+	return t.broadcaster.watch(ctx, filter, opts)
+}
+
+func (t *threadSafeMap) ListWithVersion() ([]interface{}, uint64) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	live := t.unexpired()
+	list := make([]interface{}, 0, t.store.len())
+	t.store.eachItem(func(key string, item interface{}) {
+		if live(key) {
+			list = append(list, item)
+		}
+	})
+	return list, t.broadcaster.currentVersion()
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2020 firemiles(miles.dev@outlook.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package relation
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watch", func() {
+	var (
+		c      Cache
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	subObj1 := &Object{ID: "sub_object1"}
+	obj1 := &Object{ID: "object1", SubObjects: []*Object{subObj1}}
+
+	BeforeEach(func() {
+		c = NewCache(ObjectKey, ObjectRefers, WithWatchHistory(3))
+		ctx, cancel = context.WithCancel(context.Background())
+	})
+	AfterEach(func() {
+		cancel()
+	})
+
+	It("Receive events", func() {
+		events, err := c.Watch(ctx, nil)
+		Expect(err).ShouldNot(HaveOccurred())
+		newObj1 := &Object{ID: obj1.ID}
+		Expect(c.Add(obj1)).ShouldNot(HaveOccurred())
+		Expect(c.Update(newObj1)).ShouldNot(HaveOccurred())
+		Expect(c.Delete(newObj1)).ShouldNot(HaveOccurred())
+		Expect(c.Replace([]interface{}{subObj1})).ShouldNot(HaveOccurred())
+
+		Expect(<-events).Should(Equal(Event{Type: Added, Key: obj1.ID, Object: obj1, Version: 1}))
+		Expect(<-events).Should(Equal(Event{Type: Updated, Key: obj1.ID, Object: newObj1, OldObject: obj1, Version: 2}))
+		Expect(<-events).Should(Equal(Event{Type: Deleted, Key: obj1.ID, Object: newObj1, Version: 3}))
+		Expect(<-events).Should(Equal(Event{Type: Replaced, Delta: &ReplaceDelta{Added: []string{subObj1.ID}}, Version: 4}))
+
+		cancel()
+		Eventually(events).Should(BeClosed())
+	})
+
+	It("Filter events", func() {
+		events, err := c.Watch(ctx, func(event Event) bool {
+			return event.Key == subObj1.ID
+		})
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(c.Add(obj1)).ShouldNot(HaveOccurred())
+		Expect(c.Add(subObj1)).ShouldNot(HaveOccurred())
+		Expect((<-events).Version).Should(Equal(uint64(2)))
+		Consistently(events).ShouldNot(Receive())
+	})
+
+	It("Resume from version", func() {
+		Expect(c.Add(obj1)).ShouldNot(HaveOccurred())
+		_, version := c.ListWithVersion()
+		Expect(version).Should(Equal(uint64(1)))
+		Expect(c.Add(subObj1)).ShouldNot(HaveOccurred())
+		Expect(c.Delete(obj1)).ShouldNot(HaveOccurred())
+
+		events, err := c.Watch(ctx, nil, WatchFromVersion(version))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect((<-events).Version).Should(Equal(uint64(2)))
+		Expect((<-events).Version).Should(Equal(uint64(3)))
+		Expect(c.Delete(subObj1)).ShouldNot(HaveOccurred())
+		Expect((<-events).Version).Should(Equal(uint64(4)))
+
+		_, err = c.Watch(ctx, nil, WatchFromVersion(0))
+		Expect(err).Should(Equal(ErrVersionTooOld))
+		_, current := c.ListWithVersion()
+		_, err = c.Watch(ctx, nil, WatchFromVersion(current+1))
+		Expect(err).Should(Equal(ErrVersionInFuture))
+		_, err = c.Watch(ctx, nil, WatchFromVersion(1))
+		Expect(err).ShouldNot(HaveOccurred())
+	})
+
+	It("Disconnect slow consumer", func() {
+		events, err := c.Watch(ctx, nil, WatchBufferSize(1))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(c.Add(obj1)).ShouldNot(HaveOccurred())
+		Expect(c.Add(subObj1)).ShouldNot(HaveOccurred())
+		Expect((<-events).Version).Should(Equal(uint64(1)))
+		Eventually(events).Should(BeClosed())
+	})
+
+	It("Drop events of slow consumer", func() {
+		events, err := c.Watch(ctx, nil, WatchBufferSize(1), WatchSlowConsumerPolicy(SlowConsumerDrop))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(c.Add(obj1)).ShouldNot(HaveOccurred())
+		Expect(c.Add(subObj1)).ShouldNot(HaveOccurred())
+		Expect((<-events).Version).Should(Equal(uint64(1)))
+		Expect(c.Delete(obj1)).ShouldNot(HaveOccurred())
+		Expect((<-events).Version).Should(Equal(uint64(3)))
+	})
+
+	It("Block writers for slow consumer", func() {
+		events, err := c.Watch(ctx, nil, WatchBufferSize(1), WatchSlowConsumerPolicy(SlowConsumerBlock))
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(c.Add(obj1)).ShouldNot(HaveOccurred())
+		added := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			Expect(c.Add(subObj1)).ShouldNot(HaveOccurred())
+			close(added)
+		}()
+		Consistently(added, 50*time.Millisecond).ShouldNot(BeClosed())
+		Expect((<-events).Version).Should(Equal(uint64(1)))
+		Eventually(added).Should(BeClosed())
+		Expect((<-events).Version).Should(Equal(uint64(2)))
+	})
+})
+
+var _ = Describe("Referent changes", func() {
+	var (
+		c       Cache
+		changes []ReferentChange
+	)
+	sub := &Object{ID: "sub"}
+	obj1 := &Object{ID: "obj1", SubObjects: []*Object{sub}}
+	obj2 := &Object{ID: "obj2", SubObjects: []*Object{sub, obj1}}
+
+	BeforeEach(func() {
+		changes = nil
+		c = NewCache(ObjectKey, ObjectRefers, WithReferentChangedFunc(func(change ReferentChange) {
+			changes = append(changes, change)
+		}))
+		Expect(c.Add(obj1)).ShouldNot(HaveOccurred())
+		Expect(c.Add(obj2)).ShouldNot(HaveOccurred())
+	})
+
+	It("Notify referrers", func() {
+		Expect(changes).Should(BeEmpty())
+		Expect(c.Add(sub)).ShouldNot(HaveOccurred())
+		Expect(c.Update(sub)).ShouldNot(HaveOccurred())
+		Expect(c.Delete(sub)).ShouldNot(HaveOccurred())
+		Expect(changes).Should(Equal([]ReferentChange{
+			{Referrer: obj1.ID, Referent: sub.ID, Type: Added},
+			{Referrer: obj2.ID, Referent: sub.ID, Type: Added},
+			{Referrer: obj1.ID, Referent: sub.ID, Type: Updated},
+			{Referrer: obj2.ID, Referent: sub.ID, Type: Updated},
+			{Referrer: obj1.ID, Referent: sub.ID, Type: Deleted},
+			{Referrer: obj2.ID, Referent: sub.ID, Type: Deleted},
+		}))
+	})
+
+	It("Notify orphans only", func() {
+		Expect(c.Add(sub)).ShouldNot(HaveOccurred())
+		changes = nil
+		_, err := c.DeleteCascade(obj1, DeletePropagationForeground)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(changes).Should(BeEmpty())
+		_, err = c.DeleteCascade(sub, DeletePropagationOrphan)
+		Expect(err).ShouldNot(HaveOccurred())
+		Expect(changes).Should(BeEmpty())
+	})
+
+	It("Notify on replace", func() {
+		changes = nil
+		Expect(c.Replace([]interface{}{obj2, sub})).ShouldNot(HaveOccurred())
+		Expect(changes).Should(Equal([]ReferentChange{
+			{Referrer: obj2.ID, Referent: sub.ID, Type: Added},
+			{Referrer: obj2.ID, Referent: obj1.ID, Type: Deleted},
+		}))
+	})
+})